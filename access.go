@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipFilter decides which hosts can connect at all, before any junction is checked
+type ipFilter struct {
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	privateOnly bool
+}
+
+var connFilter *ipFilter
+
+/*
+newIPFilter parses the allowed and denied addresses
+
+Parameters:
+
+	allow       - Addresses or CIDR ranges that can connect
+	deny        - Addresses or CIDR ranges that can't connect, even if allowed
+	privateOnly - Whether only private, loopback and link-local addresses can connect when allow is empty
+
+Returns:
+
+	*ipFilter   - The filter, or nil if every host can connect
+	error       - Why an address is invalid
+*/
+func newIPFilter(allow []string, deny []string, privateOnly bool) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 && !privateOnly {
+		return nil, nil
+	}
+
+	filter := &ipFilter{privateOnly: privateOnly}
+	var err error
+	if filter.allow, err = parseIPList(allow); err != nil {
+		return nil, fmt.Errorf("allow-ips: %w", err)
+	}
+	if filter.deny, err = parseIPList(deny); err != nil {
+		return nil, fmt.Errorf("deny-ips: %w", err)
+	}
+	return filter, nil
+}
+
+/*
+parseIPList parses addresses and CIDR ranges, a plain address matching only itself
+
+Parameters:
+
+	list       - The configured addresses
+
+Returns:
+
+	[]*net.IPNet - The parsed ranges
+	error        - Why an address is invalid
+*/
+func parseIPList(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+/*
+allowed determines if a host can connect. Denied addresses always lose, then the host must
+be in the allowed list if there is one, or private if only private addresses are trusted.
+
+Parameters:
+
+	ip   - The connecting host's address
+
+Returns:
+
+	bool - Whether the host can connect
+*/
+func (f *ipFilter) allowed(ip net.IP) bool {
+	// No filter configured
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allow) > 0 {
+		for _, ipNet := range f.allow {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if f.privateOnly {
+		return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+	}
+	return true
+}
+
+/*
+addrIP gets the IP address of a connection's remote address
+
+Parameters:
+
+	addr   - The remote address
+
+Returns:
+
+	net.IP - The address, or nil if it isn't an IP address
+*/
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
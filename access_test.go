@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIPFilter(t *testing.T) {
+	var tests = []struct {
+		allow       []string
+		deny        []string
+		privateOnly bool
+		ip          string
+		want        bool
+	}{
+		{nil, nil, false, "203.0.113.5", true},
+		{[]string{"192.168.1.0/24"}, nil, false, "192.168.1.20", true},
+		{[]string{"192.168.1.0/24"}, nil, false, "192.168.2.20", false},
+		{[]string{"192.168.1.0/24"}, []string{"192.168.1.20"}, false, "192.168.1.20", false},
+		{nil, []string{"203.0.113.0/24"}, false, "203.0.113.5", false},
+		{nil, []string{"203.0.113.0/24"}, false, "198.51.100.5", true},
+		{nil, nil, true, "10.1.2.3", true},
+		{nil, nil, true, "127.0.0.1", true},
+		{nil, nil, true, "::1", true},
+		{nil, nil, true, "fd00::1", true},
+		{nil, nil, true, "203.0.113.5", false},
+		{[]string{"203.0.113.5"}, nil, true, "203.0.113.5", true},
+		{[]string{"2001:db8::/32"}, nil, false, "2001:db8::25", true},
+		{[]string{"192.168.1.5"}, nil, false, "::ffff:192.168.1.5", true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			filter, err := newIPFilter(test.allow, test.deny, test.privateOnly)
+			if err != nil {
+				t.Fatalf("received error '%s'", err)
+			}
+			allowed := filter.allowed(net.ParseIP(test.ip))
+			if allowed != test.want {
+				t.Errorf("received '%t', wanted '%t'", allowed, test.want)
+			}
+		})
+	}
+}
+
+func TestIPFilterErrors(t *testing.T) {
+	var tests = []struct {
+		allow []string
+		deny  []string
+	}{
+		{[]string{"192.168.1.0/33"}, nil},
+		{nil, []string{"not-an-ip"}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if _, err := newIPFilter(test.allow, test.deny, false); err == nil {
+				t.Errorf("received no error, wanted one")
+			}
+		})
+	}
+}
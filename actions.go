@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// What a junction does with the emails it matches
+const (
+	actionNotify  = "notify"   // Send a notification
+	actionDrop    = "drop"     // Accept the email and discard it
+	actionReject  = "reject"   // Refuse the email with a permanent error
+	actionLogOnly = "log-only" // Accept the email and only log it
+)
+
+// The reply text used when a rejecting junction doesn't set one
+const defaultRejectMessage = "Message rejected"
+
+// errRejected is returned to smtpd for an email a junction rejects, its 451 is replaced with the junction's reply
+var errRejected = errors.New("rejected by junction")
+
+/*
+checkAction validates the junction's action
+
+Returns:
+
+	error - Why the action is invalid
+*/
+func (junction *Junction) checkAction() error {
+	switch junction.Action {
+	case "", actionNotify:
+		if !junction.hasDestination() {
+			return errors.New("apprise, routes, relay, webhook or exec must be set to notify")
+		}
+	case actionDrop, actionLogOnly:
+	case actionReject:
+		if strings.ContainsAny(junction.RejectMessage, "\r\n") {
+			return errors.New("reject-message must be a single line")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", junction.Action)
+	}
+	return nil
+}
+
+/*
+hasApprise determines if the junction sends notifications through Apprise
+
+Returns:
+
+	bool - Whether an Apprise URL or routes are set
+*/
+func (junction *Junction) hasApprise() bool {
+	return junction.Apprise != "" || len(junction.Routes) > 0
+}
+
+/*
+hasDestination determines if the junction has anywhere to send the emails it matches
+
+Returns:
+
+	bool - Whether Apprise, a relay, a webhook or a command is set
+*/
+func (junction *Junction) hasDestination() bool {
+	return junction.hasApprise() || junction.Relay.Server != "" || junction.Webhook.URL != "" || junction.Exec.Command != ""
+}
+
+/*
+rejectReply builds the SMTP reply for an email the junction rejects
+
+Parameters:
+
+	junction - The rejecting junction
+
+Returns:
+
+	string   - The reply, without the line ending
+*/
+func rejectReply(junction Junction) string {
+	message := junction.RejectMessage
+	if message == "" {
+		message = defaultRejectMessage
+	}
+	return fmt.Sprintf("550 5.7.1 %s", message)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckAction(t *testing.T) {
+	var tests = []struct {
+		junction Junction
+		valid    bool
+	}{
+		{Junction{Apprise: "json://localhost"}, true},
+		{Junction{Action: actionNotify, Routes: map[string]string{"ops": "json://localhost"}}, true},
+		{Junction{Action: actionNotify}, false},
+		{Junction{Action: actionDrop}, true},
+		{Junction{Action: actionLogOnly}, true},
+		{Junction{Action: actionReject, RejectMessage: "No thanks"}, true},
+		{Junction{Action: actionReject, RejectMessage: "No\r\n250 thanks"}, false},
+		{Junction{Action: "ignore"}, false},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			err := test.junction.checkAction()
+			if (err == nil) != test.valid {
+				t.Errorf("received '%v', wanted valid '%t'", err, test.valid)
+			}
+		})
+	}
+}
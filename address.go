@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Addresses struct {
+	FoldCase  bool   `yaml:"fold-case,omitempty"`
+	StripTags bool   `yaml:"strip-tags,omitempty"`
+	Separator string `yaml:"separator,omitempty"`
+}
+
+// The separator used when the config doesn't set one, as in "notify+tag@example.com"
+const defaultTagSeparator = "+"
+
+var addressConf Addresses
+
+// Where a junction's addresses are taken from
+const (
+	sourceEnvelope = "envelope" // The SMTP envelope, MAIL FROM and RCPT TO
+	sourceHeader   = "header"   // The To and Cc headers
+	sourceFrom     = "from"     // The From header
+	sourceReplyTo  = "reply-to" // The Reply-To header
+	sourceSender   = "sender"   // The Sender header
+)
+
+/*
+checkAddresses validates the junction's 'to' and 'from' blocks
+
+Returns:
+
+	error - Why a block is invalid
+*/
+func (junction *Junction) checkAddresses() error {
+	if junction.To.MinMatch > len(junction.To.Emails) {
+		return fmt.Errorf("min-match %d is more than the %d emails listed", junction.To.MinMatch, len(junction.To.Emails))
+	}
+
+	switch junction.To.Source {
+	case "", sourceEnvelope, sourceHeader:
+	default:
+		return fmt.Errorf("unknown to source %q", junction.To.Source)
+	}
+
+	switch junction.From.Source {
+	case "", sourceEnvelope, sourceFrom, sourceReplyTo, sourceSender:
+	default:
+		return fmt.Errorf("unknown from source %q", junction.From.Source)
+	}
+	return nil
+}
+
+/*
+toAddresses gets the recipients a junction's 'to' block matches against
+
+Parameters:
+
+	source   - Where to take the recipients from
+	email    - The received email
+
+Returns:
+
+	[]string - The recipients
+*/
+func toAddresses(source string, email EmailData) []string {
+	if source != sourceHeader {
+		return email.To
+	}
+	return append(headerAddresses(email.Headers, "To"), headerAddresses(email.Headers, "Cc")...)
+}
+
+/*
+fromAddress gets the sender a junction's 'from' block matches against
+
+Parameters:
+
+	source - Where to take the sender from
+	email  - The received email
+
+Returns:
+
+	string - The sender, or empty if the header isn't present
+*/
+func fromAddress(source string, email EmailData) string {
+	var header string
+	switch source {
+	case sourceFrom:
+		header = "From"
+	case sourceReplyTo:
+		header = "Reply-To"
+	case sourceSender:
+		header = "Sender"
+	default:
+		return email.From
+	}
+
+	addresses := headerAddresses(email.Headers, header)
+	if len(addresses) == 0 {
+		return ""
+	}
+	return addresses[0]
+}
+
+/*
+headerAddresses gets the bare addresses from an address header, such as
+"alerts@example.com" from `"Alerts" <alerts@example.com>`
+
+Parameters:
+
+	headers  - The email's headers
+	name     - The header to read
+
+Returns:
+
+	[]string - The addresses, empty if the header is missing or can't be parsed
+*/
+func headerAddresses(headers mail.Header, name string) []string {
+	if headers.Get(name) == "" {
+		return nil
+	}
+
+	list, err := headers.AddressList(name)
+	if err != nil {
+		log.Debug().Err(err).Str("header", name).Msg("     Can't parse addresses")
+		return nil
+	}
+	addresses := make([]string, 0, len(list))
+	for _, address := range list {
+		addresses = append(addresses, address.Address)
+	}
+	return addresses
+}
+
+/*
+tagSeparator gets the separator between an address's local part and its tag
+
+Returns:
+
+	string - The configured separator, or "+" if there isn't one
+*/
+func tagSeparator() string {
+	if addressConf.Separator == "" {
+		return defaultTagSeparator
+	}
+	return addressConf.Separator
+}
+
+/*
+splitAddress parses an address, such as `"Alerts" <Alerts+disk@Example.com>`, into its parts
+
+Parameters:
+
+	address - The address to parse
+
+Returns:
+
+	string  - The local part without its tag, such as "Alerts"
+	string  - The tag, such as "disk", or empty if there isn't one
+	string  - The lowercased domain, such as "example.com"
+*/
+func splitAddress(address string) (string, string, string) {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		address = parsed.Address
+	} else {
+		address = strings.Trim(strings.TrimSpace(address), "<>")
+	}
+
+	local, domain := address, ""
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		local, domain = address[:at], strings.ToLower(address[at+1:])
+	}
+
+	local, tag, _ := strings.Cut(local, tagSeparator())
+	return local, tag, domain
+}
+
+/*
+normalizeAddress prepares an address for comparison, lowercasing its domain and, if configured,
+its local part and removing its tag
+
+Parameters:
+
+	address - The address to normalize
+
+Returns:
+
+	string  - The normalized address
+*/
+func normalizeAddress(address string) string {
+	local, tag, domain := splitAddress(address)
+	if tag != "" && !addressConf.StripTags {
+		local += tagSeparator() + tag
+	}
+	if addressConf.FoldCase {
+		local = strings.ToLower(local)
+	}
+	if domain == "" {
+		return local
+	}
+	return local + "@" + domain
+}
+
+/*
+addressTag gets the subaddress tag of the first address that has one
+
+Parameters:
+
+	addresses - The addresses to check
+
+Returns:
+
+	string    - The tag, such as "disk" for "alerts+disk@example.com", or empty if none has one
+*/
+func addressTag(addresses []string) string {
+	for _, address := range addresses {
+		if _, tag, _ := splitAddress(address); tag != "" {
+			return tag
+		}
+	}
+	return ""
+}
+
+/*
+checkTag determines if a recipient has the junction's tag
+
+Parameters:
+
+	juncTag   - The tag a recipient must have
+	addresses - The recipients to check
+
+Returns:
+
+	bool      - Whether or not the condition matches
+*/
+func checkTag(juncTag string, addresses []string) bool {
+	log.Debug().Msg("   Checking 'to tag' condition")
+	// If there is no tag, match by default
+	if juncTag == "" {
+		log.Debug().Msg("     No condition provided, matches by default")
+		return true
+	}
+
+	for _, address := range addresses {
+		_, tag, _ := splitAddress(address)
+		matched := strings.EqualFold(tag, juncTag)
+		log.Debug().Str("provided tag", juncTag).Str("received tag", tag).Bool("matches", matched).Msg("     ")
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestSourceAddresses(t *testing.T) {
+	raw := "From: \"Backup Server\" <backup@example.com>\r\n" +
+		"Reply-To: ops@example.com, oncall@example.com\r\n" +
+		"To: Alerts <alerts@example.com>\r\n" +
+		"Cc: team@example.com\r\n\r\nbody"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := EmailData{From: "bounce@relay.net", To: []string{"relay@example.com"}, Headers: msg.Header}
+
+	var tests = []struct {
+		toSource   string
+		fromSource string
+		to         []string
+		from       string
+	}{
+		{"", "", []string{"relay@example.com"}, "bounce@relay.net"},
+		{sourceEnvelope, sourceEnvelope, []string{"relay@example.com"}, "bounce@relay.net"},
+		{sourceHeader, sourceFrom, []string{"alerts@example.com", "team@example.com"}, "backup@example.com"},
+		{sourceHeader, sourceReplyTo, []string{"alerts@example.com", "team@example.com"}, "ops@example.com"},
+		{sourceHeader, sourceSender, []string{"alerts@example.com", "team@example.com"}, ""},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			to := toAddresses(test.toSource, email)
+			if fmt.Sprint(to) != fmt.Sprint(test.to) {
+				t.Errorf("received '%v', wanted '%v'", to, test.to)
+			}
+			from := fromAddress(test.fromSource, email)
+			if from != test.from {
+				t.Errorf("received '%s', wanted '%s'", from, test.from)
+			}
+		})
+	}
+}
+
+func TestCheckAddresses(t *testing.T) {
+	var tests = []struct {
+		junction Junction
+		valid    bool
+	}{
+		{Junction{}, true},
+		{Junction{To: JuncTo{Source: sourceHeader}, From: JuncFrom{Source: sourceReplyTo}}, true},
+		{Junction{To: JuncTo{Source: sourceFrom}}, false},
+		{Junction{From: JuncFrom{Source: "cc"}}, false},
+		{Junction{To: JuncTo{Emails: []string{"a@test.com", "b@test.com"}, MinMatch: 2}}, true},
+		{Junction{To: JuncTo{Emails: []string{"a@test.com"}, MinMatch: 2}}, false},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			err := test.junction.checkAddresses()
+			if (err == nil) != test.valid {
+				t.Errorf("received '%v', wanted valid '%t'", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	defer func(previous Addresses) { addressConf = previous }(addressConf)
+
+	var tests = []struct {
+		conf    Addresses
+		address string
+		want    string
+		tag     string
+	}{
+		{Addresses{}, "alerts@example.com", "alerts@example.com", ""},
+		{Addresses{}, "Alerts@Example.COM", "Alerts@example.com", ""},
+		{Addresses{}, `"Backup" <backup@Example.com>`, "backup@example.com", ""},
+		{Addresses{}, "<notify+disk@example.com>", "notify+disk@example.com", "disk"},
+		{Addresses{FoldCase: true}, "Alerts@Example.COM", "alerts@example.com", ""},
+		{Addresses{StripTags: true}, "notify+Discord-Ops@example.com", "notify@example.com", "Discord-Ops"},
+		{Addresses{FoldCase: true, StripTags: true}, `"Notify" <Notify+ops@Junction.Local>`, "notify@junction.local", "ops"},
+		{Addresses{StripTags: true, Separator: "-"}, "notify-ops@example.com", "notify@example.com", "ops"},
+		{Addresses{StripTags: true}, "notify", "notify", ""},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			addressConf = test.conf
+			normalized := normalizeAddress(test.address)
+			if normalized != test.want {
+				t.Errorf("received '%s', wanted '%s'", normalized, test.want)
+			}
+			tag := addressTag([]string{test.address})
+			if tag != test.tag {
+				t.Errorf("received tag '%s', wanted '%s'", tag, test.tag)
+			}
+		})
+	}
+}
+
+func TestCheckTag(t *testing.T) {
+	var tests = []struct {
+		juncTag   string
+		addresses []string
+		want      bool
+	}{
+		{"", []string{"notify@example.com"}, true},
+		{"ops", []string{"notify@example.com"}, false},
+		{"ops", []string{"notify+disk@example.com", "notify+OPS@example.com"}, true},
+		{"ops", []string{"notify+disk@example.com"}, false},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			matched := checkTag(test.juncTag, test.addresses)
+			if matched != test.want {
+				t.Errorf("received '%t', wanted '%t'", matched, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+// AuthResults are the outcomes of checking who really sent an email
+type AuthResults struct {
+	SPF   string // pass, fail, softfail, neutral, none, temperror or permerror
+	DKIM  string // pass, fail, none, temperror or permerror
+	DMARC string // pass, fail, none, temperror or permerror
+}
+
+// The results that aren't specific to one check
+const (
+	authPass      = "pass"
+	authFail      = "fail"
+	authNone      = "none"
+	authTempError = "temperror"
+	authPermError = "permerror"
+)
+
+// How long the DNS lookups for one email can take
+const authTimeout = 10 * time.Second
+
+// authResolver looks up the DNS records the checks need. net.Resolver implements it.
+type authResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// resolver is replaced in tests so the checks can run offline
+var resolver authResolver = net.DefaultResolver
+
+// verifySenders is set when the checks should run for every email
+var verifySenders bool
+
+/*
+hasAuthConditions determines if any junction has a condition on the sender checks,
+so they need to run even if they weren't asked for
+
+Returns:
+
+	bool - Whether a junction has a condition
+*/
+func hasAuthConditions() bool {
+	for index := range junctions {
+		from := junctions[index].From
+		if from.SPF != "" || from.DKIM != "" || from.DMARC != "" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+checkAuth runs the SPF, DKIM and DMARC checks for an email
+
+Parameters:
+
+	ctx         - Carries the logger for the email
+	email       - The received email, with its headers parsed
+	raw         - The raw email, as the DKIM signatures cover it
+
+Returns:
+
+	AuthResults - The results of each check
+*/
+func checkAuth(ctx context.Context, email EmailData, raw []byte) AuthResults {
+	ctx, cancel := context.WithTimeout(ctx, authTimeout)
+	defer cancel()
+	logger := zerolog.Ctx(ctx)
+
+	lookupTXT := func(domain string) ([]string, error) {
+		return resolver.LookupTXT(ctx, domain)
+	}
+
+	// SPF checks the connecting IP against the envelope sender's domain, or the HELO name for bounces
+	var results AuthResults
+	spfResult, err := spf.CheckHostWithSender(net.ParseIP(email.IP), email.Helo, email.From, spf.WithContext(ctx), spf.WithResolver(resolver))
+	if err != nil {
+		logger.Debug().Err(err).Msg("SPF check error")
+	}
+	results.SPF = string(spfResult)
+
+	// DKIM checks the signatures, passing if any of them is valid
+	results.DKIM = authNone
+	var dkimDomains []string
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	if err != nil {
+		logger.Debug().Err(err).Msg("DKIM check error")
+		results.DKIM = authPermError
+	}
+	for _, v := range verifications {
+		switch {
+		case v.Err == nil:
+			results.DKIM = authPass
+			dkimDomains = append(dkimDomains, v.Domain)
+		case dkim.IsTempFail(v.Err) && results.DKIM != authPass:
+			results.DKIM = authTempError
+		case results.DKIM == authNone:
+			results.DKIM = authFail
+		}
+		if v.Err != nil {
+			logger.Debug().Err(v.Err).Str("domain", v.Domain).Msg("DKIM signature invalid")
+		}
+	}
+
+	results.DMARC = checkDMARC(email, spfResult, dkimDomains, lookupTXT)
+	logger.Debug().Str("spf", results.SPF).Str("dkim", results.DKIM).Str("dmarc", results.DMARC).Msg("Sender checks")
+	return results
+}
+
+/*
+checkDMARC determines if the domain in the From header published a DMARC policy, and if the
+email passed SPF or DKIM for a domain aligned with it
+
+Parameters:
+
+	email       - The received email
+	spfResult   - The result of the SPF check
+	dkimDomains - The domains of the valid DKIM signatures
+	lookupTXT   - Looks up TXT records
+
+Returns:
+
+	string      - pass, fail, none, temperror or permerror
+*/
+func checkDMARC(email EmailData, spfResult spf.Result, dkimDomains []string, lookupTXT func(string) ([]string, error)) string {
+	from, err := email.Headers.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return authPermError
+	}
+	fromDomain := addressDomain(from[0].Address)
+	if fromDomain == "" {
+		return authPermError
+	}
+
+	// Fall back to the organizational domain's policy, so mail from a subdomain is covered
+	options := &dmarc.LookupOptions{LookupTXT: lookupTXT}
+	record, err := dmarc.LookupWithOptions(fromDomain, options)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		if org := orgDomain(fromDomain); org != fromDomain {
+			record, err = dmarc.LookupWithOptions(org, options)
+		}
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return authNone
+	case dmarc.IsTempFail(err):
+		return authTempError
+	case err != nil:
+		return authPermError
+	}
+
+	spfDomain := addressDomain(email.From)
+	if spfDomain == "" {
+		spfDomain = strings.ToLower(email.Helo)
+	}
+	if spfResult == spf.Pass && aligned(fromDomain, spfDomain, record.SPFAlignment) {
+		return authPass
+	}
+	for _, domain := range dkimDomains {
+		if aligned(fromDomain, domain, record.DKIMAlignment) {
+			return authPass
+		}
+	}
+	return authFail
+}
+
+/*
+aligned determines if an authenticated domain matches the From header's domain
+
+Parameters:
+
+	fromDomain - The domain in the From header
+	domain     - The domain that passed SPF or DKIM
+	mode       - Strict needs the same domain, relaxed only the same organizational domain
+
+Returns:
+
+	bool       - Whether the domains are aligned
+*/
+func aligned(fromDomain string, domain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(domain)
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+	return orgDomain(domain) == orgDomain(fromDomain)
+}
+
+/*
+orgDomain gets the registered part of a domain, such as example.co.uk for mail.example.co.uk
+
+Parameters:
+
+	domain - The domain
+
+Returns:
+
+	string - The organizational domain, or the domain itself if it has none
+*/
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+/*
+addressDomain gets the lowercased domain of an email address
+
+Parameters:
+
+	address - The email address
+
+Returns:
+
+	string  - The domain, or empty if there isn't one
+*/
+func addressDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(address[at+1:], "> "))
+}
+
+/*
+checkAuthConditions determines if the sender checks satisfy the junction's conditions
+
+Parameters:
+
+	juncFrom - The 'From' block of the junction to compare with
+	results  - The results of the email's sender checks
+
+Returns:
+
+	bool     - Whether or not the conditions match
+*/
+func checkAuthConditions(juncFrom JuncFrom, results AuthResults) bool {
+	conditions := []struct {
+		name     string
+		provided string
+		received string
+	}{
+		{"spf", juncFrom.SPF, results.SPF},
+		{"dkim", juncFrom.DKIM, results.DKIM},
+		{"dmarc", juncFrom.DMARC, results.DMARC},
+	}
+
+	for _, condition := range conditions {
+		log.Debug().Msg("   Checking 'from " + condition.name + "' condition")
+		// If there is no condition, match by default
+		if condition.provided == "" {
+			log.Debug().Msg("     No condition provided, matches by default")
+			continue
+		}
+		matched := strings.EqualFold(condition.provided, condition.received)
+		log.Debug().Str("provided result", condition.provided).Str("received result", condition.received).Bool("matches", matched).Msg("     ")
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// fakeResolver answers TXT lookups from a map, and finds nothing else
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r[strings.TrimSuffix(name, ".")]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestCheckAuth(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previous authResolver) { resolver = previous }(resolver)
+	resolver = fakeResolver{
+		"example.com":                  {"v=spf1 ip4:192.0.2.10 -all"},
+		"mail._domainkey.example.com":  {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+		"_dmarc.example.com":           {"v=DMARC1; p=reject"},
+		"mail._domainkey.attacker.net": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	sign := func(domain string, raw string) string {
+		var signed bytes.Buffer
+		err := dkim.Sign(&signed, strings.NewReader(raw), &dkim.SignOptions{Domain: domain, Selector: "mail", Signer: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed.String()
+	}
+	raw := "From: Server <server@example.com>\r\nSubject: Backup done\r\n\r\nAll good\r\n"
+
+	var tests = []struct {
+		ip   string
+		from string
+		raw  string
+		want AuthResults
+	}{
+		// Sent from the right server, and signed
+		{"192.0.2.10", "server@example.com", sign("example.com", raw), AuthResults{"pass", "pass", "pass"}},
+		// Signed, but sent from elsewhere
+		{"203.0.113.5", "server@example.com", sign("example.com", raw), AuthResults{"fail", "pass", "pass"}},
+		// Sent from the right server, not signed
+		{"192.0.2.10", "server@example.com", raw, AuthResults{"pass", "none", "pass"}},
+		// Spoofed from elsewhere
+		{"203.0.113.5", "server@example.com", raw, AuthResults{"fail", "none", "fail"}},
+		// Signed by a domain that isn't aligned with the From header
+		{"203.0.113.5", "bounce@attacker.net", sign("attacker.net", raw), AuthResults{"none", "pass", "fail"}},
+		// The signature doesn't cover the changed subject
+		{"203.0.113.5", "server@example.com", strings.Replace(sign("example.com", raw), "Backup done", "Backup failed", 1), AuthResults{"fail", "fail", "fail"}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			msg, err := mail.ReadMessage(strings.NewReader(test.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			email := EmailData{From: test.from, IP: test.ip, Helo: "mx.example.com", Headers: msg.Header}
+			results := checkAuth(context.Background(), email, []byte(test.raw))
+			if results != test.want {
+				t.Errorf("received '%+v', wanted '%+v'", results, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckAuthConditions(t *testing.T) {
+	var tests = []struct {
+		juncFrom JuncFrom
+		results  AuthResults
+		want     bool
+	}{
+		{JuncFrom{}, AuthResults{}, true},
+		{JuncFrom{DKIM: "pass"}, AuthResults{"fail", "pass", "fail"}, true},
+		{JuncFrom{DKIM: "pass", SPF: "pass"}, AuthResults{"fail", "pass", "fail"}, false},
+		{JuncFrom{DMARC: "PASS"}, AuthResults{"pass", "none", "pass"}, true},
+		{JuncFrom{DMARC: "pass"}, AuthResults{}, false},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			matched := checkAuthConditions(test.juncFrom, test.results)
+			if matched != test.want {
+				t.Errorf("received '%t', wanted '%t'", matched, test.want)
+			}
+		})
+	}
+}
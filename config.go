@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -13,16 +14,42 @@ import (
 )
 
 type Config struct {
-	LogLevel  string     `yaml:"log-level,omitempty"`
-	Port      string     `yaml:"port,omitempty"`
-	Junctions []Junction `yaml:"junctions"`
+	LogLevel        string            `yaml:"log-level,omitempty"`
+	LogFormat       string            `yaml:"log-format,omitempty"`
+	LogFile         LogFile           `yaml:"log-file,omitempty"`
+	Port            string            `yaml:"port,omitempty"`
+	SMTP            SMTP              `yaml:"smtp,omitempty"`
+	AllowIPs        []string          `yaml:"allow-ips,omitempty"`
+	DenyIPs         []string          `yaml:"deny-ips,omitempty"`
+	PrivateOnly     bool              `yaml:"private-only,omitempty"`
+	VerifySenders   bool              `yaml:"verify-senders,omitempty"`
+	Addresses       Addresses         `yaml:"addresses,omitempty"`
+	Metrics         string            `yaml:"metrics,omitempty"`
+	RateLimit       RateLimit         `yaml:"rate-limit,omitempty"`
+	DedupeState     string            `yaml:"dedupe-state,omitempty"`
+	Templates       map[string]string `yaml:"templates,omitempty"`
+	TemplateDir     string            `yaml:"template-dir,omitempty"`
+	MaxDeliveries   int               `yaml:"max-concurrent-deliveries,omitempty"`
+	DeliveryQueue   int               `yaml:"delivery-queue,omitempty"`
+	DeliveryTimeout time.Duration     `yaml:"delivery-timeout,omitempty"`
+	ShutdownGrace   time.Duration     `yaml:"shutdown-grace,omitempty"`
+	Junctions       []Junction        `yaml:"junctions"`
 }
 
 var configPath = "config/config.yaml"
 var port = "8025"
+var smtpConf SMTP
 var logLevel string
+var logFormat string
+var metricsAddr string
+var templateDir string
+var maxDeliveries int
+var deliveryQueue int
+var deliveryTimeout time.Duration
+var shutdownGrace time.Duration
 var apprisePath string
 var junctions []Junction
+var globalLimiter *limiter
 
 /*
 getConf loads the configuration from the Environment Variables and Config File
@@ -70,15 +97,106 @@ func getConf() {
 		logLevel = conf.LogLevel
 	}
 
-	if logLevel != "" {
-		if logLevel == "debug" {
-			zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		} else {
-			zerolog.SetGlobalLevel(zerolog.InfoLevel)
-		}
+	smtpConf = conf.SMTP
+	addressConf = conf.Addresses
+	maxDeliveries = conf.MaxDeliveries
+	deliveryQueue = conf.DeliveryQueue
+	deliveryTimeout = conf.DeliveryTimeout
+	shutdownGrace = conf.ShutdownGrace
+
+	if conf.Metrics != "" {
+		metricsAddr = conf.Metrics
+	}
+	if conf.LogFormat != "" {
+		logFormat = conf.LogFormat
+	}
+
+	invalid := false
+	if err := setupLogging(logLevel, logFormat, conf.LogFile); err != nil {
+		log.Error().Err(err).Msg("Can't set up logging")
+		invalid = true
+	}
+
+	// Load the shared templates before the junctions that reference them
+	templateDir = conf.TemplateDir
+	if err := loadTemplates(conf.Templates, templateDir); err != nil {
+		log.Error().Err(err).Msg("Can't load the shared templates")
+		invalid = true
+	}
+
+	connFilter, err = newIPFilter(conf.AllowIPs, conf.DenyIPs, conf.PrivateOnly)
+	if err != nil {
+		log.Error().Err(err).Msg("Can't parse the allowed and denied addresses")
+		invalid = true
 	}
 
 	junctions = conf.Junctions
+	for index := range junctions {
+		if err := junctions[index].checkAction(); err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't use the action")
+			invalid = true
+		}
+		if err := junctions[index].checkRelay(); err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't use the relay")
+			invalid = true
+		}
+		if err := junctions[index].checkWebhook(); err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't use the webhook")
+			invalid = true
+		}
+		if err := junctions[index].checkExec(); err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't use the exec command")
+			invalid = true
+		}
+		if err := junctions[index].checkAddresses(); err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't match the junction")
+			invalid = true
+		}
+		if err := junctions[index].compileTemplates(); err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't parse the templates")
+			invalid = true
+		}
+		junctions[index].limiter, err = newLimiter(junctionID(index), junctions[index].RateLimit)
+		if err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't use the rate limit")
+			invalid = true
+		}
+		junctions[index].deduper, err = newDeduper(junctionID(index), junctions[index].Dedupe)
+		if err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't parse the dedupe key")
+			invalid = true
+		}
+		junctions[index].digester, err = newDigester(junctionID(index), junctions[index].Digest)
+		if err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't parse the digest")
+			invalid = true
+		}
+		junctions[index].quietHours, err = newQuietHours(junctionID(index), junctions[index].QuietHours)
+		if err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't parse the quiet hours")
+			invalid = true
+		}
+		junctions[index].schedule, err = parseSchedule(junctions[index].Schedule)
+		if err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't parse the schedule")
+			invalid = true
+		}
+		junctions[index].extractors, err = parseExtracts(junctions[index].Extract)
+		if err != nil {
+			log.Error().Err(err).Str("junction", junctionID(index)).Msg("Can't parse the extract section")
+			invalid = true
+		}
+	}
+	globalLimiter, err = newLimiter("global", conf.RateLimit)
+	if err != nil {
+		log.Error().Err(err).Msg("Can't use the global rate limit")
+		invalid = true
+	}
+	verifySenders = conf.VerifySenders || hasAuthConditions()
+	if invalid {
+		log.Fatal().Msg("Fix the errors in the config before starting")
+	}
+	loadDedupeState(conf.DedupeState)
 
-	log.Print(fmt.Sprintf("Log Level: %s", logLevel))
+	log.Info().Str("log-level", zerolog.GlobalLevel().String()).Str("log-format", logFormat).Msg("Logging configured")
 }
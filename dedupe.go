@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Dedupe struct {
+	Key    string        `yaml:"key,omitempty"`
+	Window time.Duration `yaml:"window"`
+	Remind time.Duration `yaml:"remind,omitempty"`
+}
+
+// The key used when a junction doesn't provide one
+const defaultDedupeKey = "{{ .Subject }}|{{ .From }}"
+
+// deduper suppresses repeats of the same email for one junction
+type deduper struct {
+	junction string
+	key      *template.Template
+	window   time.Duration
+	remind   time.Duration
+}
+
+// dedupeEntry tracks one key that has been seen recently
+type dedupeEntry struct {
+	First    time.Time `json:"first"`
+	LastSeen time.Time `json:"last_seen"`
+	Notified time.Time `json:"notified"`
+	Expires  time.Time `json:"expires"`
+	Count    int       `json:"count"`
+}
+
+// dedupeState holds the entries of every junction, optionally saved to a file so they survive a restart
+var dedupeState = struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*dedupeEntry
+	save    *time.Timer
+}{
+	entries: map[string]*dedupeEntry{},
+}
+
+// dedupeSaving stops saves from overlapping, so an older copy of the state can't replace a newer one
+var dedupeSaving sync.Mutex
+
+// How long after a change the state file is saved, so a burst of emails only writes it once
+var dedupeSaveDelay = 10 * time.Second
+
+/*
+newDeduper creates the deduper for a junction
+
+Parameters:
+
+	junction - The name of the junction
+	dedupe   - The junction's dedupe configuration
+
+Returns:
+
+	*deduper - The deduper, or nil if deduplication isn't configured
+	error    - Why the dedupe key can't be parsed
+*/
+func newDeduper(junction string, dedupe Dedupe) (*deduper, error) {
+	if dedupe.Window <= 0 {
+		return nil, nil
+	}
+
+	templatesMu.RLock()
+	shared := sharedTemplates
+	templatesMu.RUnlock()
+
+	keyTemplate, err := compileDedupeKey(shared, dedupe)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deduper{
+		junction: junction,
+		key:      keyTemplate,
+		window:   dedupe.Window,
+		remind:   dedupe.Remind,
+	}, nil
+}
+
+/*
+compileDedupeKey parses a dedupe key against a specific set of shared templates
+
+Parameters:
+
+	shared             - The shared templates the key can reference, may be nil
+	dedupe             - The junction's dedupe configuration
+
+Returns:
+
+	*template.Template - The key
+	error              - Why the key can't be parsed
+*/
+func compileDedupeKey(shared *template.Template, dedupe Dedupe) (*template.Template, error) {
+	key := dedupe.Key
+	if key == "" {
+		key = defaultDedupeKey
+	}
+	return newTemplateWith(shared, "dedupe", key)
+}
+
+/*
+check records an email and determines whether it repeats one seen within the window
+
+Parameters:
+
+	data      - The template data of the received email
+
+Returns:
+
+	duplicate - Whether the email should be suppressed
+	remind    - If non-zero, how many times the email has been seen, and a reminder should be sent
+*/
+func (d *deduper) check(data TemplateData) (duplicate bool, remind int) {
+	if d == nil {
+		return false, 0
+	}
+
+	// The key is replaced when the shared templates are reloaded
+	templatesMu.RLock()
+	keyTemplate := d.key
+	templatesMu.RUnlock()
+
+	builder := &strings.Builder{}
+	if err := keyTemplate.Execute(builder, data); err != nil {
+		log.Error().Err(err).Str("junction", d.junction).Msg("Can't build the dedupe key")
+		return false, 0
+	}
+	key := d.junction + "\x00" + builder.String()
+
+	dedupeState.mu.Lock()
+	defer dedupeState.mu.Unlock()
+	defer scheduleDedupeSave()
+
+	now := time.Now()
+	pruneDedupeState(now)
+
+	// First time this key has been seen in the window
+	entry, ok := dedupeState.entries[key]
+	if !ok {
+		dedupeState.entries[key] = &dedupeEntry{
+			First:    now,
+			LastSeen: now,
+			Notified: now,
+			Expires:  now.Add(d.window),
+			Count:    1,
+		}
+		return false, 0
+	}
+
+	// A repeat, extend the window
+	entry.LastSeen = now
+	entry.Expires = now.Add(d.window)
+	entry.Count++
+	duplicatesSuppressed.WithLabelValues(d.junction).Inc()
+
+	if d.remind > 0 && now.Sub(entry.Notified) >= d.remind {
+		entry.Notified = now
+		return true, entry.Count
+	}
+	return true, 0
+}
+
+/*
+pruneDedupeState removes entries whose window has closed. The caller must hold the lock.
+
+Parameters:
+
+	now - The current time
+*/
+func pruneDedupeState(now time.Time) {
+	for key, entry := range dedupeState.entries {
+		if now.After(entry.Expires) {
+			delete(dedupeState.entries, key)
+		}
+	}
+}
+
+/*
+loadDedupeState reads previously saved entries so that suppression survives a restart
+
+Parameters:
+
+	path - The file to read from and save to, state is only kept in memory if empty
+*/
+func loadDedupeState(path string) {
+	dedupeState.mu.Lock()
+	defer dedupeState.mu.Unlock()
+
+	if dedupeState.save != nil {
+		dedupeState.save.Stop()
+		dedupeState.save = nil
+	}
+	dedupeState.path = path
+	dedupeState.entries = map[string]*dedupeEntry{}
+	if path == "" {
+		return
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Error reading dedupe state")
+		return
+	}
+
+	if err := json.Unmarshal(b, &dedupeState.entries); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Error parsing dedupe state")
+		dedupeState.entries = map[string]*dedupeEntry{}
+	}
+	pruneDedupeState(time.Now())
+}
+
+/*
+scheduleDedupeSave saves the state file shortly, if one is configured and a save isn't already due. The caller must hold the lock.
+*/
+func scheduleDedupeSave() {
+	if dedupeState.path == "" || dedupeState.save != nil {
+		return
+	}
+	dedupeState.save = time.AfterFunc(dedupeSaveDelay, saveDedupeState)
+}
+
+/*
+saveDedupeState writes the entries to the state file, if one is configured
+*/
+func saveDedupeState() {
+	dedupeSaving.Lock()
+	defer dedupeSaving.Unlock()
+
+	// Only copy the entries under the lock, so emails aren't held up by the write
+	dedupeState.mu.Lock()
+	if dedupeState.save != nil {
+		dedupeState.save.Stop()
+		dedupeState.save = nil
+	}
+	path := dedupeState.path
+	var b []byte
+	var err error
+	if path != "" {
+		b, err = json.Marshal(dedupeState.entries)
+	}
+	dedupeState.mu.Unlock()
+
+	if path == "" {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding dedupe state")
+		return
+	}
+
+	// Write to a temporary file first so a crash can't leave a partial file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		log.Error().Err(err).Str("path", tmp).Msg("Error writing dedupe state")
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("Error writing dedupe state")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dedupeCheck is one email given to a deduper, and what it should decide
+type dedupeCheck struct {
+	wait      time.Duration
+	subject   string
+	duplicate bool
+	remind    int
+}
+
+func TestDeduperCheck(t *testing.T) {
+	var tests = []struct {
+		dedupe Dedupe
+		checks []dedupeCheck
+	}{
+		// Repeats within the window are suppressed, other emails aren't
+		{Dedupe{Window: time.Hour}, []dedupeCheck{
+			{0, "Disk full", false, 0},
+			{0, "Disk full", true, 0},
+			{0, "Disk full", true, 0},
+			{0, "Backup failed", false, 0},
+		}},
+		// Each repeat extends the window
+		{Dedupe{Window: 150 * time.Millisecond}, []dedupeCheck{
+			{0, "Disk full", false, 0},
+			{100 * time.Millisecond, "Disk full", true, 0},
+			{100 * time.Millisecond, "Disk full", true, 0},
+			{200 * time.Millisecond, "Disk full", false, 0},
+		}},
+		// A reminder reports how many times the email was seen
+		{Dedupe{Window: time.Hour, Remind: 30 * time.Millisecond}, []dedupeCheck{
+			{0, "Disk full", false, 0},
+			{0, "Disk full", true, 0},
+			{40 * time.Millisecond, "Disk full", true, 3},
+			{0, "Disk full", true, 0},
+			{40 * time.Millisecond, "Disk full", true, 5},
+		}},
+		// The key decides what counts as a repeat
+		{Dedupe{Window: time.Hour, Key: "{{ .From }}"}, []dedupeCheck{
+			{0, "Disk full", false, 0},
+			{0, "Backup failed", true, 0},
+		}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			loadDedupeState("")
+			d, err := newDeduper("test", test.dedupe)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, check := range test.checks {
+				time.Sleep(check.wait)
+				duplicate, remind := d.check(newTemplateData(EmailData{Subject: check.subject, From: "server@example.com"}))
+				if duplicate != check.duplicate || remind != check.remind {
+					t.Errorf("received '%t, %d', wanted '%t, %d' for '%s'", duplicate, remind, check.duplicate, check.remind, check.subject)
+				}
+			}
+		})
+	}
+}
+
+func TestDeduperNil(t *testing.T) {
+	d, err := newDeduper("test", Dedupe{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if duplicate, _ := d.check(newTemplateData(EmailData{Subject: "Disk full"})); duplicate {
+		t.Error("an unconfigured deduper should never suppress")
+	}
+}
+
+func TestDeduperKeyError(t *testing.T) {
+	if _, err := newDeduper("test", Dedupe{Window: time.Hour, Key: "{{ .Subject"}); err == nil {
+		t.Error("received no error, wanted one for an unparsable key")
+	}
+}
+
+func TestDedupeStateRoundTrip(t *testing.T) {
+	defer loadDedupeState("")
+	path := filepath.Join(t.TempDir(), "dedupe.json")
+
+	loadDedupeState(path)
+	d, err := newDeduper("test", Dedupe{Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := newTemplateData(EmailData{Subject: "Disk full", From: "server@example.com"})
+	d.check(email)
+	d.check(email)
+
+	// Nothing is written until the save is due
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("received '%v', wanted the file not saved yet", err)
+	}
+	saveDedupeState()
+
+	// A restart reads the saved entries back
+	loadDedupeState(path)
+	dedupeState.mu.Lock()
+	entry, ok := dedupeState.entries["test\x00Disk full|server@example.com"]
+	dedupeState.mu.Unlock()
+	if !ok {
+		t.Fatal("received no entry, wanted the saved one")
+	}
+	if entry.Count != 2 {
+		t.Errorf("received '%d', wanted '%d'", entry.Count, 2)
+	}
+	if duplicate, _ := d.check(email); !duplicate {
+		t.Error("received not a duplicate, wanted the saved entry to suppress the email")
+	}
+
+	// Expired entries aren't loaded
+	dedupeState.mu.Lock()
+	for _, entry := range dedupeState.entries {
+		entry.Expires = time.Now().Add(-time.Minute)
+	}
+	dedupeState.mu.Unlock()
+	saveDedupeState()
+	loadDedupeState(path)
+	dedupeState.mu.Lock()
+	remaining := len(dedupeState.entries)
+	dedupeState.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("received '%d', wanted '%d'", remaining, 0)
+	}
+}
+
+func TestDedupeStateSavedLater(t *testing.T) {
+	defer loadDedupeState("")
+	defer func(previous time.Duration) { dedupeSaveDelay = previous }(dedupeSaveDelay)
+	dedupeSaveDelay = 50 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "dedupe.json")
+
+	loadDedupeState(path)
+	d, err := newDeduper("test", Dedupe{Window: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.check(newTemplateData(EmailData{Subject: "Disk full"}))
+	d.check(newTemplateData(EmailData{Subject: "Backup failed"}))
+
+	// Both emails are saved together once the delay is up
+	deadline := time.Now().Add(time.Second)
+	for {
+		b, err := os.ReadFile(path)
+		if err == nil {
+			var entries map[string]*dedupeEntry
+			if err := json.Unmarshal(b, &entries); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("received '%d', wanted '%d'", len(entries), 2)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dedupe state was never saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Defaults used when the config doesn't set them
+const (
+	defaultMaxDeliveries   = 4
+	defaultDeliveryQueue   = 100
+	defaultDeliveryTimeout = 30 * time.Second
+)
+
+// errBusy is returned to smtpd when the delivery queue is full, which it reports to the sender as a 451
+var errBusy = errors.New("delivery queue is full")
+
+// delivery is a notification, or other send, waiting in the queue
+type delivery struct {
+	logger *zerolog.Logger
+	send   func(ctx context.Context)
+}
+
+// deliveryPool sends notifications with a fixed number of workers
+type deliveryPool struct {
+	queue   chan delivery
+	timeout time.Duration
+	wg      sync.WaitGroup
+
+	// ctx is cancelled to stop in-flight deliveries if shutdown runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards closed, so nothing is queued once shutdown has closed the queue
+	mu     sync.RWMutex
+	closed bool
+}
+
+var deliveries *deliveryPool
+
+/*
+startDeliveries starts the workers that send notifications
+
+Parameters:
+
+	workers       - How many notifications can be sent at once
+	queueSize     - How many notifications can wait to be sent before new emails are refused
+	timeout       - How long a single notification can take before it is cancelled
+
+Returns:
+
+	*deliveryPool - The running pool
+*/
+func startDeliveries(workers int, queueSize int, timeout time.Duration) *deliveryPool {
+	if workers <= 0 {
+		workers = defaultMaxDeliveries
+	}
+	if queueSize <= 0 {
+		queueSize = defaultDeliveryQueue
+	}
+	if timeout <= 0 {
+		timeout = defaultDeliveryTimeout
+	}
+
+	pool := &deliveryPool{
+		queue:   make(chan delivery, queueSize),
+		timeout: timeout,
+	}
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
+
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+
+	return pool
+}
+
+/*
+work sends queued notifications until the queue is closed
+*/
+func (p *deliveryPool) work() {
+	defer p.wg.Done()
+
+	for d := range p.queue {
+		ctx, cancel := context.WithTimeout(d.logger.WithContext(p.ctx), p.timeout)
+		d.send(ctx)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			zerolog.Ctx(ctx).Error().Dur("timeout", p.timeout).Msg("Delivery timed out")
+		}
+		cancel()
+		queueDepth.Dec()
+	}
+}
+
+/*
+enqueue adds a send to the queue, waiting for space if it is full.
+Sends immediately if no pool is running.
+
+Waiting holds up the caller: an SMTP session, or the timer releasing quiet hours, draining held rate limits or
+flushing a digest. None of them hold other locks while queueing, and mailHandler refuses emails once the queue
+is full, so the wait only lasts until a worker finishes a send, which the delivery timeout bounds.
+Shutdown waits for the senders already waiting before it closes the queue.
+
+Parameters:
+
+	ctx   - Carries the logger for the email being delivered
+	send  - Sends the notification, cancelled through its context if it takes too long
+*/
+func (p *deliveryPool) enqueue(ctx context.Context, send func(ctx context.Context)) {
+	if p == nil {
+		send(ctx)
+		return
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		zerolog.Ctx(ctx).Error().Str("status", "failed").Msg("Shutting down, notification not sent")
+		return
+	}
+
+	// The delivery outlives the SMTP transaction, so only keep the logger from its context
+	queueDepth.Inc()
+	p.queue <- delivery{
+		logger: zerolog.Ctx(ctx),
+		send:   send,
+	}
+}
+
+/*
+shutdown stops accepting notifications and waits for the queued ones to be delivered.
+In-flight deliveries are cancelled if the context finishes first.
+
+Parameters:
+
+	ctx   - Limits how long to wait
+
+Returns:
+
+	error - The context's error if it finished before the queue was drained
+*/
+func (p *deliveryPool) shutdown(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		// Give the cancelled deliveries a moment to stop their Apprise processes
+		p.cancel()
+		select {
+		case <-drained:
+		case <-time.After(2 * time.Second):
+		}
+		return ctx.Err()
+	}
+}
+
+/*
+saturated determines if the queue is full, and new emails should be refused
+
+Returns:
+
+	bool - Whether the queue is full
+*/
+func (p *deliveryPool) saturated() bool {
+	return p != nil && len(p.queue) >= cap(p.queue)
+}
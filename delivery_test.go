@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeliveryPoolSaturated(t *testing.T) {
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = startDeliveries(1, 2, time.Second)
+
+	// Hold the only worker, then fill the queue behind it
+	started := make(chan bool)
+	release := make(chan bool)
+	deliveries.enqueue(context.Background(), func(ctx context.Context) {
+		started <- true
+		<-release
+	})
+	<-started
+	sent := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		deliveries.enqueue(context.Background(), func(ctx context.Context) { sent <- true })
+	}
+
+	if !deliveries.saturated() {
+		t.Error("received not saturated, wanted the full queue saturated")
+	}
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	if err := mailHandler(remoteAddr, "server@example.com", []string{"alerts@example.com"}, []byte("Subject: Disk full\r\n\r\n")); !errors.Is(err, errBusy) {
+		t.Errorf("received '%v', wanted '%v'", err, errBusy)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatal("queued delivery was never sent")
+		}
+	}
+	if deliveries.saturated() {
+		t.Error("received saturated, wanted the drained queue to have space")
+	}
+	if err := deliveries.shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeliveryTimeout(t *testing.T) {
+	pool := startDeliveries(1, 1, 100*time.Millisecond)
+
+	// A hung process is killed once the delivery runs out of time
+	result := make(chan error, 1)
+	start := time.Now()
+	pool.enqueue(context.Background(), func(ctx context.Context) {
+		_, _, err := runExec(ctx, "sh", []string{"-c", "sleep 5"}, nil, nil)
+		result <- err
+	})
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("received no error, wanted the process killed")
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("received '%s', wanted the process killed at the delivery timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was never stopped")
+	}
+	pool.shutdown(context.Background())
+}
+
+func TestEnqueueAfterShutdown(t *testing.T) {
+	pool := startDeliveries(1, 1, time.Second)
+	if err := pool.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is sent, and the closed queue doesn't panic
+	sent := false
+	pool.enqueue(context.Background(), func(ctx context.Context) { sent = true })
+	if sent {
+		t.Error("received a delivery, wanted none after shutdown")
+	}
+	if err := pool.shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeliveryPoolNil(t *testing.T) {
+	var pool *deliveryPool
+	if pool.saturated() {
+		t.Error("received saturated, wanted no pool to never be saturated")
+	}
+
+	sent := false
+	pool.enqueue(context.Background(), func(ctx context.Context) { sent = true })
+	if !sent {
+		t.Error("received no delivery, wanted it sent immediately without a pool")
+	}
+}
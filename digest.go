@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Digest struct {
+	Every time.Duration `yaml:"every,omitempty"`
+	Max   int           `yaml:"max,omitempty"`
+	Title string        `yaml:"title,omitempty"`
+	Body  string        `yaml:"body,omitempty"`
+}
+
+// DigestData is the data available to a digest's templates
+type DigestData struct {
+	Junction string         // The name of the junction
+	Emails   []TemplateData // Every email collected since the last flush, oldest first
+}
+
+// The templates used when a digest doesn't provide them
+const (
+	defaultDigestTitle = "{{ len .Emails }} emails for {{ .Junction }}"
+	defaultDigestBody  = "{{ range .Emails }}{{ .Date }} {{ .Subject }}\n{{ end }}"
+)
+
+// digester buffers the emails matched by one junction and sends them as one notification
+type digester struct {
+	mu       sync.Mutex
+	junction string
+	every    time.Duration
+	max      int
+	title    *template.Template
+	body     *template.Template
+	emails   []TemplateData
+	send     func(title string, body string)
+	timer    *time.Timer
+}
+
+/*
+newDigester creates the digester for a junction
+
+Parameters:
+
+	junction  - The name of the junction
+	digest    - The junction's digest configuration
+
+Returns:
+
+	*digester - The digester, or nil if digest mode isn't configured
+	error     - Why the digest's title or body can't be parsed
+*/
+func newDigester(junction string, digest Digest) (*digester, error) {
+	if digest.Every <= 0 && digest.Max <= 0 {
+		return nil, nil
+	}
+
+	templatesMu.RLock()
+	shared := sharedTemplates
+	templatesMu.RUnlock()
+
+	title, body, err := compileDigest(shared, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &digester{
+		junction: junction,
+		every:    digest.Every,
+		max:      digest.Max,
+		title:    title,
+		body:     body,
+	}, nil
+}
+
+/*
+compileDigest parses a digest's title and body against a specific set of shared templates
+
+Parameters:
+
+	shared             - The shared templates the digest can reference, may be nil
+	digest             - The junction's digest configuration
+
+Returns:
+
+	*template.Template - The title
+	*template.Template - The body
+	error              - Why the title or body can't be parsed
+*/
+func compileDigest(shared *template.Template, digest Digest) (*template.Template, *template.Template, error) {
+	parse := func(name string, text string, fallback string) (*template.Template, error) {
+		if text == "" {
+			text = fallback
+		}
+		parsed, err := newTemplateWith(shared, name, text)
+		if err != nil {
+			return nil, fmt.Errorf("digest %s: %w", name, err)
+		}
+		return parsed, nil
+	}
+
+	title, err := parse("title", digest.Title, defaultDigestTitle)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := parse("body", digest.Body, defaultDigestBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	return title, body, nil
+}
+
+/*
+add buffers an email, flushing the digest if it has reached its maximum size
+
+Parameters:
+
+	data - The template data of the received email
+	send - Sends the digest's notification, the most recent email's is used when flushing
+*/
+func (d *digester) add(data TemplateData, send func(title string, body string)) {
+	d.mu.Lock()
+	d.emails = append(d.emails, data)
+	d.send = send
+
+	if d.max > 0 && len(d.emails) >= d.max {
+		d.mu.Unlock()
+		d.flush()
+		return
+	}
+
+	// Start the schedule with the first email of a new digest
+	if d.every > 0 && d.timer == nil {
+		d.timer = time.AfterFunc(d.every, d.flush)
+	}
+	d.mu.Unlock()
+}
+
+/*
+flush sends every buffered email as a single notification
+*/
+func (d *digester) flush() {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	emails := d.emails
+	send := d.send
+	d.emails = nil
+	d.mu.Unlock()
+
+	if len(emails) == 0 {
+		return
+	}
+
+	data := DigestData{
+		Junction: d.junction,
+		Emails:   emails,
+	}
+
+	// The templates are replaced when the shared templates are reloaded
+	templatesMu.RLock()
+	titleTemplate, bodyTemplate := d.title, d.body
+	templatesMu.RUnlock()
+
+	title := &strings.Builder{}
+	if err := titleTemplate.Execute(title, data); err != nil {
+		log.Error().Err(err).Str("junction", d.junction).Msg("Can't build the digest title")
+	}
+	body := &strings.Builder{}
+	if err := bodyTemplate.Execute(body, data); err != nil {
+		log.Error().Err(err).Str("junction", d.junction).Msg("Can't build the digest body")
+	}
+
+	log.Info().Str("junction", d.junction).Int("emails", len(emails)).Msg("Flushing digest")
+	send(title.String(), body.String())
+}
+
+/*
+flushDigests sends every junction's collected emails now, rather than waiting for their schedule
+*/
+func flushDigests() {
+	for index := range junctions {
+		if junctions[index].digester != nil {
+			junctions[index].digester.flush()
+		}
+	}
+}
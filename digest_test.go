@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDigesterMax(t *testing.T) {
+	var tests = []struct {
+		digest   Digest
+		subjects []string
+		title    string
+		body     string
+	}{
+		{
+			Digest{Max: 2},
+			[]string{"Backup done", "Backup failed"},
+			"2 emails for test",
+			"Mon, 1 Jan 2024 Backup done\nMon, 1 Jan 2024 Backup failed\n",
+		},
+		{
+			Digest{Max: 3, Title: "{{ .Junction }} digest", Body: "{{ range .Emails }}{{ .Subject | upper }};{{ end }}"},
+			[]string{"a", "b", "c"},
+			"test digest",
+			"A;B;C;",
+		},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			d, err := newDigester("test", test.digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sent := 0
+			var title, body string
+			for index, subject := range test.subjects {
+				if sent != 0 {
+					t.Fatalf("received a digest after %d emails, wanted it after %d", index, len(test.subjects))
+				}
+				d.add(newTemplateData(EmailData{Subject: subject, Date: "Mon, 1 Jan 2024"}), func(t string, b string) {
+					sent++
+					title, body = t, b
+				})
+			}
+
+			if sent != 1 {
+				t.Fatalf("received '%d' digests, wanted '%d'", sent, 1)
+			}
+			if title != test.title {
+				t.Errorf("received '%s', wanted '%s'", title, test.title)
+			}
+			if body != test.body {
+				t.Errorf("received '%s', wanted '%s'", body, test.body)
+			}
+
+			// Nothing is left to send after the flush
+			d.flush()
+			if sent != 1 {
+				t.Errorf("received '%d' digests, wanted '%d'", sent, 1)
+			}
+		})
+	}
+}
+
+func TestDigesterEvery(t *testing.T) {
+	d, err := newDigester("test", Digest{Every: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	titles := make(chan string, 2)
+	send := func(title string, body string) { titles <- title }
+	d.add(newTemplateData(EmailData{Subject: "Backup done"}), send)
+	d.add(newTemplateData(EmailData{Subject: "Backup failed"}), send)
+
+	select {
+	case title := <-titles:
+		if title != "2 emails for test" {
+			t.Errorf("received '%s', wanted '%s'", title, "2 emails for test")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("digest was never sent")
+	}
+
+	// The next email starts a new digest
+	d.add(newTemplateData(EmailData{Subject: "Backup done"}), send)
+	select {
+	case title := <-titles:
+		if title != "1 emails for test" {
+			t.Errorf("received '%s', wanted '%s'", title, "1 emails for test")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second digest was never sent")
+	}
+}
+
+func TestNewDigesterErrors(t *testing.T) {
+	var tests = []struct {
+		digest Digest
+		err    bool
+	}{
+		{Digest{}, false},
+		{Digest{Max: 2}, false},
+		{Digest{Max: 2, Title: "{{ .Junction"}, true},
+		{Digest{Every: time.Hour, Body: "{{ range .Emails }}"}, true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			_, err := newDigester("test", test.digest)
+			if (err != nil) != test.err {
+				t.Errorf("received '%v', wanted an error '%t'", err, test.err)
+			}
+		})
+	}
+}
@@ -2,30 +2,34 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/mail"
 	"strings"
+	"time"
 
-	"github.com/mhale/smtpd"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 type EmailData struct {
-	To      []string
-	From    string
-	Subject string
-	Body    string
-	Date    string
-	IP      string
-}
-
-func startServer() {
-	log.Info().Msg(fmt.Sprintf("Listening on port %s", port))
-	if err := smtpd.ListenAndServe(fmt.Sprintf(":%s", port), mailHandler, "", ""); err != nil {
-		log.Error().Err(err).Msg("Error with the SMTP server")
-	}
+	To        []string
+	From      string
+	Subject   string
+	Body      string
+	Date      string
+	IP        string
+	Headers   mail.Header
+	MessageID string
+	Size      int
+	Helo      string
+	Received  time.Time
+	Fields    map[string]string
+	Auth      AuthResults
+	Tag       string
 }
 
 /*
@@ -39,63 +43,212 @@ Parameters:
 	data     - The raw email data
 */
 func mailHandler(remoteIP net.Addr, from string, to []string, data []byte) error {
-	log.Info().Msg("Email Received")
-
 	// Transform the IP into a string
 	ip, _, err := net.SplitHostPort(remoteIP.String())
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to retrieve the ip")
 	}
 
-	log.Debug().Str("to", strings.Trim(fmt.Sprint(to), "[]")).Str("from", from).Str("ip", ip).Send()
+	// Tag every log line for this email with the same fields
+	logger := log.With().Str("message_id", newMessageID()).Str("remote_ip", ip).Logger()
+	ctx := logger.WithContext(context.Background())
+
+	logger.Info().Int("size", len(data)).Msg("Email Received")
+	emailsReceived.Inc()
+	messageSize.Observe(float64(len(data)))
+	logger.Debug().Str("to", strings.Trim(fmt.Sprint(to), "[]")).Str("from", from).Send()
+
+	// Ask the sender to retry later rather than queue more than we can deliver
+	if deliveries.saturated() {
+		logger.Warn().Msg("Delivery queue is full, refusing email")
+		emailsRejected.WithLabelValues("busy").Inc()
+		return errBusy
+	}
+
+	email := EmailData{
+		To:       to,
+		From:     from,
+		IP:       ip,
+		Headers:  mail.Header{},
+		Tag:      addressTag(to),
+		Size:     len(data),
+		Received: time.Now(),
+	}
 
 	// Parse the email
-	var emailSubject string
-	var emailDate string
-	var emailBody string
+	parseStart := time.Now()
 	msg, err := mail.ReadMessage(bytes.NewReader(data))
 	if err != nil {
-		log.Error().Err(err).Msg("Can't parse email")
-		emailBody = "There was an error when parsing the email"
+		logger.Error().Err(err).Msg("Can't parse email")
+		emailParseErrors.Inc()
+		email.Body = "There was an error when parsing the email"
 	} else {
-		emailSubject = msg.Header.Get("Subject")
-		emailDate = msg.Header.Get("Date")
+		email.Headers = msg.Header
+		email.Subject = msg.Header.Get("Subject")
+		email.Date = msg.Header.Get("Date")
+		email.MessageID = msg.Header.Get("Message-ID")
+		email.Helo = heloName(msg.Header.Get("Received"))
 		builder := &strings.Builder{}
 		_, err = io.Copy(builder, msg.Body)
 		if err != nil {
-			log.Error().Err(err).Msg("Error with email body")
+			logger.Error().Err(err).Msg("Error with email body")
 		}
-		emailBody = builder.String()
+		email.Body = builder.String()
+	}
+	parseDuration.Observe(time.Since(parseStart).Seconds())
+
+	// Check who really sent the email, when something needs to know
+	if verifySenders && msg != nil {
+		email.Auth = checkAuth(ctx, email, data)
 	}
 
 	// Determine which junction to use, or return if none found
-	index := selectJunction(to, from, ip)
+	index := selectJunction(email)
 	if index < 0 {
-		log.Error().Msg("No junction matches the received email")
+		logger.Warn().Msg("No junction matches the received email")
+		emailsUnmatched.Inc()
 		return nil
 	}
+	templatesMu.RLock()
 	junction := junctions[index]
+	templatesMu.RUnlock()
+
+	// Capture the junction's fields for its templates
+	email.Fields = extractFields(junction.extractors, email)
+
+	name := junctionID(index)
+	junctionMatches.WithLabelValues(name).Inc()
+	ctx = logger.With().Str("junction", name).Logger().WithContext(ctx)
+
+	// Junctions that don't notify are finished with the email here
+	switch junction.Action {
+	case actionDrop:
+		zerolog.Ctx(ctx).Info().Str("action", actionDrop).Msg("Email dropped")
+		emailsDropped.WithLabelValues(name, actionDrop).Inc()
+		return nil
+	case actionLogOnly:
+		zerolog.Ctx(ctx).Info().Str("action", actionLogOnly).Str("subject", email.Subject).Str("from", email.From).Str("to", strings.Join(email.To, ",")).Msg("Email logged")
+		emailsDropped.WithLabelValues(name, actionLogOnly).Inc()
+		return nil
+	case actionReject:
+		reply := rejectReply(junction)
+		zerolog.Ctx(ctx).Info().Str("action", actionReject).Str("reply", reply).Msg("Email rejected")
+		emailsDropped.WithLabelValues(name, actionReject).Inc()
+		rejections.set(remoteIP, reply)
+		return errRejected
+	}
 
 	// Prepare the title and body for the message
-	title, body, url := buildMessage(EmailData{
-		to,
-		from,
-		emailSubject,
-		emailBody,
-		emailDate,
-		ip,
-	}, junction)
-
-	// Get the index or junction name for the logs
-	id := func() string {
-		if junction.Name == "" {
-			return fmt.Sprint(index)
+	notification, err := buildMessage(email, junction)
+	built := err == nil
+	if err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Str("status", "failed").Msg("Can't build the notification")
+		reason := "template"
+		if errors.Is(err, errNoRoute) {
+			reason = "route"
 		}
-		return junction.Name
+		notificationErrors.WithLabelValues(reason).Inc()
 	}
+	// Without a route the title and body are still rendered, otherwise one of them may have failed
+	rendered := built || errors.Is(err, errNoRoute)
 
-	// Send it
-	log.Info().Str("junction id", id()).Msg("Sending Notification")
-	sendNotification(title, body, url)
+	// Forward every email to the relay, webhook and command as it arrives, alongside any notification,
+	// even if the notification itself can't be built. Duplicates are only suppressed for the notification.
+	if junction.Relay.Server != "" {
+		if junction.Relay.Mode == relayModeRendered && !rendered {
+			zerolog.Ctx(ctx).Error().Str("backend", "relay").Str("status", "failed").Msg("Can't relay the rendered email without its title and body")
+		} else {
+			msg := relayMessage(junction.Relay, email, data, notification)
+			deliveries.enqueue(ctx, func(ctx context.Context) { sendRelay(ctx, junction.Relay, from, msg) })
+		}
+	}
+	if junction.Webhook.URL != "" {
+		payload, err := webhookPayload(name, email, notification)
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Str("backend", "webhook").Str("status", "failed").Msg("Can't encode the webhook")
+		} else {
+			deliveries.enqueue(ctx, func(ctx context.Context) { sendWebhook(ctx, junction.Webhook, payload) })
+		}
+	}
+	if junction.Exec.Command != "" {
+		args, env, err := execCommand(name, junction, email, notification)
+		if err == nil {
+			var stdin []byte
+			if stdin, err = execStdin(junction.Exec.Stdin, name, email, data, notification); err == nil {
+				deliveries.enqueue(ctx, func(ctx context.Context) { sendExec(ctx, junction.Exec, args, env, stdin) })
+			}
+		}
+		if err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Str("backend", "exec").Str("status", "failed").Msg("Can't prepare the command")
+		}
+	}
+	if !built || !junction.hasApprise() {
+		return nil
+	}
+
+	// Send it once quiet hours are over, subject to the junction's and then the global rate limit
+	notify := func(title string, body string) {
+		deliver := func() {
+			zerolog.Ctx(ctx).Info().Msg("Sending Notification")
+			n := notification
+			n.Title, n.Body = title, body
+			deliveries.enqueue(ctx, func(ctx context.Context) { sendNotification(ctx, n) })
+		}
+		summary := func(count int) {
+			zerolog.Ctx(ctx).Info().Int("suppressed", count).Msg("Sending rate limit summary")
+			n := notification
+			n.Title = fmt.Sprintf("%d more messages suppressed", count)
+			n.Body = fmt.Sprintf("%d notifications for %s were suppressed by the rate limit", count, name)
+			deliveries.enqueue(ctx, func(ctx context.Context) { sendNotification(ctx, n) })
+		}
+		// The junction's summary is a notification too, so it still has to pass the global limit
+		limitedSummary := func(count int) {
+			globalLimiter.admit(name, func() { summary(count) }, summary)
+		}
+		junction.quietHours.admit(func() {
+			junction.limiter.admit(name, func() { globalLimiter.admit(name, deliver, summary) }, limitedSummary)
+		})
+	}
+
+	// Suppress repeats of a recent email, occasionally reminding that it's still happening
+	emailData := newTemplateData(email)
+	duplicate, count := junction.deduper.check(emailData)
+	if duplicate {
+		if count == 0 {
+			zerolog.Ctx(ctx).Info().Msg("Duplicate email suppressed")
+			return nil
+		}
+		zerolog.Ctx(ctx).Info().Int("count", count).Msg("Duplicate email still firing, sending reminder")
+		notification.Title = fmt.Sprintf("%s (still firing x%d)", notification.Title, count)
+	}
+
+	// Collect the email into the junction's digest instead of sending it now
+	if junction.digester != nil {
+		zerolog.Ctx(ctx).Info().Msg("Email added to digest")
+		junction.digester.add(emailData, notify)
+		return nil
+	}
+
+	notify(notification.Title, notification.Body)
 	return nil
 }
+
+/*
+heloName gets the name the sending machine gave in HELO/EHLO from the Received header smtpd adds
+
+Parameters:
+
+	received - The first Received header of the email
+
+Returns:
+
+	string   - The HELO name, or empty if it isn't present
+*/
+func heloName(received string) string {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(received), "from ")
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, " ")
+	return name
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMailHandlerDestinationsWithoutNotification(t *testing.T) {
+	defer func(previous []Junction) { junctions = previous }(junctions)
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = nil
+
+	var tests = []struct {
+		junction Junction
+		relayed  bool
+		title    string
+	}{
+		// No route for the tag, the title and body are still rendered
+		{Junction{Routes: map[string]string{"disk": "json://localhost"}, Title: "{{ .Subject | upper }}"}, true, "BACKUP FAILED"},
+		// A failing title template, a raw relay doesn't need it
+		{Junction{Apprise: "json://localhost", Title: `{{ regexFind "(" .Subject }}`}, true, ""},
+		// A failing title template, a rendered relay can't be built without it
+		{Junction{Apprise: "json://localhost", Title: `{{ regexFind "(" .Subject }}`, Relay: Relay{Mode: relayModeRendered}}, false, ""},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			posted := make(chan WebhookPayload, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var payload WebhookPayload
+				body, _ := io.ReadAll(r.Body)
+				json.Unmarshal(body, &payload)
+				posted <- payload
+			}))
+			defer server.Close()
+			upstream, relayed := startUpstream(t)
+
+			junction := test.junction
+			junction.Webhook = Webhook{URL: server.URL}
+			junction.Relay.Server = upstream
+			junction.Relay.To = []string{"archive@example.com"}
+			junction.Relay.TLS = relayTLSNone
+			junctions = []Junction{junction}
+			if err := junctions[0].compileTemplates(); err != nil {
+				t.Fatal(err)
+			}
+
+			remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+			data := []byte("Subject: Backup failed\r\n\r\nnas backup failed\r\n")
+			if err := mailHandler(remoteAddr, "server@example.com", []string{"alerts+backup@example.com"}, data); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case payload := <-posted:
+				if payload.Title != test.title {
+					t.Errorf("received '%s', wanted '%s'", payload.Title, test.title)
+				}
+				if payload.Email.Subject != "Backup failed" {
+					t.Errorf("received '%s', wanted '%s'", payload.Email.Subject, "Backup failed")
+				}
+			case <-time.After(time.Second):
+				t.Error("received no webhook, wanted the email posted")
+			}
+
+			select {
+			case <-relayed:
+				if !test.relayed {
+					t.Error("received a relayed email, wanted none")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if test.relayed {
+					t.Error("received no relayed email, wanted the email relayed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type Exec struct {
+	Command string            `yaml:"command,omitempty"`
+	Args    []string          `yaml:"args,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Stdin   string            `yaml:"stdin,omitempty"`
+	Timeout time.Duration     `yaml:"timeout,omitempty"`
+}
+
+// What the command is given on stdin
+const (
+	stdinRaw  = "raw"  // The received email, untouched
+	stdinJSON = "json" // The same JSON posted to webhooks
+	stdinNone = "none" // Nothing
+)
+
+// The time a command can take when the config doesn't set one
+const defaultExecTimeout = 30 * time.Second
+
+// Characters that can't be used in an environment variable's name
+var envNameRegex = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+/*
+checkExec validates the junction's command
+
+Returns:
+
+	error - Why the command can't be run
+*/
+func (junction *Junction) checkExec() error {
+	if junction.Exec.Command == "" {
+		if len(junction.Exec.Args) > 0 || len(junction.Exec.Env) > 0 {
+			return errors.New("exec needs a command")
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath(junction.Exec.Command); err != nil {
+		return err
+	}
+	switch junction.Exec.Stdin {
+	case "", stdinRaw, stdinJSON, stdinNone:
+	default:
+		return fmt.Errorf("unknown exec stdin %q", junction.Exec.Stdin)
+	}
+	return nil
+}
+
+/*
+compileExec parses the templates in the command's arguments and environment
+
+Parameters:
+
+	shared - The shared templates the junction can reference, may be nil
+
+Returns:
+
+	error  - Why a template can't be parsed
+*/
+func (junction *Junction) compileExec(shared *template.Template) error {
+	junction.execArgTemplates = nil
+	for index, arg := range junction.Exec.Args {
+		argTemplate, err := newTemplateWith(shared, fmt.Sprintf("exec-arg-%d", index), arg)
+		if err != nil {
+			return err
+		}
+		junction.execArgTemplates = append(junction.execArgTemplates, argTemplate)
+	}
+
+	junction.execEnvTemplates = nil
+	if len(junction.Exec.Env) > 0 {
+		junction.execEnvTemplates = map[string]*template.Template{}
+	}
+	for name, value := range junction.Exec.Env {
+		envTemplate, err := newTemplateWith(shared, "exec-env-"+name, value)
+		if err != nil {
+			return err
+		}
+		junction.execEnvTemplates[name] = envTemplate
+	}
+	return nil
+}
+
+/*
+execCommand renders the command's arguments and environment for an email
+
+Parameters:
+
+	name         - The name of the matched junction
+	junction     - The matched junction
+	email        - The received email
+	notification - The rendered notification
+
+Returns:
+
+	[]string     - The arguments
+	[]string     - The environment variables as KEY=value, added to Junction's own
+	error        - Why a template couldn't be executed
+*/
+func execCommand(name string, junction Junction, email EmailData, notification Notification) ([]string, []string, error) {
+	templateData := newTemplateData(email)
+	render := func(t *template.Template) (string, error) {
+		builder := &strings.Builder{}
+		err := t.Execute(builder, templateData)
+		return builder.String(), err
+	}
+
+	args := make([]string, 0, len(junction.execArgTemplates))
+	for _, argTemplate := range junction.execArgTemplates {
+		arg, err := render(argTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, arg)
+	}
+
+	env := []string{
+		"JUNCTION_NAME=" + name,
+		"JUNCTION_FROM=" + email.From,
+		"JUNCTION_TO=" + strings.Join(email.To, ","),
+		"JUNCTION_SUBJECT=" + email.Subject,
+		"JUNCTION_IP=" + email.IP,
+		"JUNCTION_MESSAGE_ID=" + email.MessageID,
+		"JUNCTION_TAG=" + email.Tag,
+		"JUNCTION_TITLE=" + notification.Title,
+	}
+	for field, value := range email.Fields {
+		env = append(env, "JUNCTION_FIELD_"+envNameRegex.ReplaceAllString(strings.ToUpper(field), "_")+"="+value)
+	}
+	for key, envTemplate := range junction.execEnvTemplates {
+		value, err := render(envTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		env = append(env, key+"="+value)
+	}
+
+	return args, env, nil
+}
+
+/*
+execStdin builds what the command is given on stdin
+
+Parameters:
+
+	stdin        - raw, json or none
+	name         - The name of the matched junction
+	email        - The received email
+	raw          - The raw received email
+	notification - The rendered notification
+
+Returns:
+
+	[]byte       - The data for stdin
+	error        - Why the email can't be encoded
+*/
+func execStdin(stdin string, name string, email EmailData, raw []byte, notification Notification) ([]byte, error) {
+	switch stdin {
+	case stdinNone:
+		return nil, nil
+	case stdinJSON:
+		return webhookPayload(name, email, notification)
+	default:
+		return raw, nil
+	}
+}
+
+/*
+runExec runs a command, killing it if it runs out of time
+
+Parameters:
+
+	ctx     - Limits how long the command can run
+	command - The command to run
+	args    - Its arguments
+	env     - Environment variables added to Junction's own
+	stdin   - The data for stdin
+
+Returns:
+
+	[]byte  - The command's combined stdout and stderr
+	int     - Its exit code, or -1 if it didn't exit normally
+	error   - Why the command failed
+*/
+func runExec(ctx context.Context, command string, args []string, env []string, stdin []byte) ([]byte, int, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return output, exitCode, err
+}
+
+/*
+sendExec runs the junction's command for an email, recording it like a notification
+
+Parameters:
+
+	ctx   - Carries the logger for the email being delivered, and the delivery's deadline
+	e     - The junction's command
+	args  - The rendered arguments
+	env   - The rendered environment variables
+	stdin - The data for stdin
+*/
+func sendExec(ctx context.Context, e Exec, args []string, env []string, stdin []byte) {
+	logger := zerolog.Ctx(ctx)
+	const backend = "exec"
+
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	output, exitCode, err := runExec(ctx, e.Command, args, env, stdin)
+	notifyDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	logger.Debug().Str("output", strings.TrimSpace(string(output))).Msg("Exec output")
+	if err != nil {
+		notificationsFailed.WithLabelValues(backend).Inc()
+		logger.Error().Err(err).Str("backend", backend).Str("command", e.Command).Int("exit_code", exitCode).Str("status", "failed").Msg("Command returned an error")
+		return
+	}
+
+	notificationsSent.WithLabelValues(backend).Inc()
+	logger.Info().Str("backend", backend).Str("command", e.Command).Int("exit_code", exitCode).Str("status", "delivered").Msg("Command run")
+}
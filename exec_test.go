@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecCommand(t *testing.T) {
+	junction := Junction{Exec: Exec{
+		Command: "sh",
+		Args:    []string{"-c", "{{ .Subject | lower }}", "{{ index .Fields \"Host\" }}"},
+		Env:     map[string]string{"DISK": "{{ .From }}"},
+	}}
+	if err := junction.compileTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	email := EmailData{
+		To:      []string{"alerts+disk@example.com"},
+		From:    "server@example.com",
+		Subject: "Disk Full",
+		Tag:     "disk",
+		Fields:  map[string]string{"Host": "nas", "free space": "0"},
+	}
+
+	args, env, err := execCommand("storage", junction, email, Notification{Title: "DISK FULL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, wanted := strings.Join(args, " "), "-c disk full nas"; received != wanted {
+		t.Errorf("received '%s', wanted '%s'", received, wanted)
+	}
+
+	sort.Strings(env)
+	for _, wanted := range []string{
+		"DISK=server@example.com",
+		"JUNCTION_FIELD_FREE_SPACE=0",
+		"JUNCTION_FIELD_HOST=nas",
+		"JUNCTION_NAME=storage",
+		"JUNCTION_SUBJECT=Disk Full",
+		"JUNCTION_TAG=disk",
+		"JUNCTION_TITLE=DISK FULL",
+		"JUNCTION_TO=alerts+disk@example.com",
+	} {
+		index := sort.SearchStrings(env, wanted)
+		if index == len(env) || env[index] != wanted {
+			t.Errorf("received '%s', wanted '%s' included", strings.Join(env, " "), wanted)
+		}
+	}
+}
+
+func TestRunExec(t *testing.T) {
+	var tests = []struct {
+		script   string
+		stdin    string
+		timeout  time.Duration
+		output   string
+		exitCode int
+		failed   bool
+	}{
+		{"cat", "Subject: Disk full", time.Second, "Subject: Disk full", 0, false},
+		{"echo \"$JUNCTION_NAME $1\"", "", time.Second, "storage nas", 0, false},
+		{"echo broken >&2; exit 3", "", time.Second, "broken", 3, true},
+		{"sleep 5", "", 100 * time.Millisecond, "", -1, true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+
+			start := time.Now()
+			output, exitCode, err := runExec(ctx, "sh", []string{"-c", test.script, "sh", "nas"}, []string{"JUNCTION_NAME=storage"}, []byte(test.stdin))
+			if received := strings.TrimSpace(string(output)); received != test.output {
+				t.Errorf("received '%s', wanted '%s'", received, test.output)
+			}
+			if exitCode != test.exitCode {
+				t.Errorf("received '%d', wanted '%d'", exitCode, test.exitCode)
+			}
+			if (err != nil) != test.failed {
+				t.Errorf("received '%v', wanted failed '%t'", err, test.failed)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("received '%s', wanted the command killed at its timeout", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Extract struct {
+	Name   string `yaml:"name,omitempty"`
+	Regex  string `yaml:"regex,omitempty"`
+	Parser string `yaml:"parser,omitempty"`
+	Source string `yaml:"source,omitempty"`
+}
+
+// The ways fields can be extracted
+const (
+	parserRegex    = "regex"
+	parserKeyValue = "key-value"
+	parserJSON     = "json"
+)
+
+// extractor is a parsed Extract
+type extractor struct {
+	name   string
+	regex  *regexp.Regexp
+	parser string
+	source string
+}
+
+// Matches "Key: Value" and "Key=Value" lines
+var keyValueRegex = regexp.MustCompile(`(?m)^\s*([\w][\w .-]*?)\s*[:=]\s*(.*?)\s*$`)
+
+/*
+parseExtracts validates a junction's extract section and prepares it for use
+
+Parameters:
+
+	extracts     - The configured extracts
+
+Returns:
+
+	[]extractor  - The parsed extractors
+	error        - Why an extract is invalid
+*/
+func parseExtracts(extracts []Extract) ([]extractor, error) {
+	var parsed []extractor
+	for index, extract := range extracts {
+		e := extractor{
+			name:   extract.Name,
+			parser: extract.Parser,
+			source: extract.Source,
+		}
+
+		switch e.source {
+		case "":
+			e.source = "body"
+		case "body", "subject":
+		default:
+			return nil, fmt.Errorf("extract %d: unknown source %q", index, e.source)
+		}
+
+		if e.parser == "" {
+			e.parser = parserRegex
+		}
+		switch e.parser {
+		case parserRegex:
+			regex, err := regexp.Compile(extract.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("extract %d: %w", index, err)
+			}
+			if e.name == "" && len(regex.SubexpNames()) <= 1 {
+				return nil, fmt.Errorf("extract %d: a regex needs a name or named groups", index)
+			}
+			e.regex = regex
+		case parserKeyValue, parserJSON:
+		default:
+			return nil, fmt.Errorf("extract %d: unknown parser %q", index, e.parser)
+		}
+
+		parsed = append(parsed, e)
+	}
+
+	return parsed, nil
+}
+
+/*
+extractFields runs a junction's extractors against an email
+
+Parameters:
+
+	extractors - The junction's extractors
+	email      - The received email
+
+Returns:
+
+	map[string]string - The captured values by name, later extractors overwrite earlier ones
+*/
+func extractFields(extractors []extractor, email EmailData) map[string]string {
+	fields := map[string]string{}
+	for _, e := range extractors {
+		text := email.Body
+		if e.source == "subject" {
+			text = email.Subject
+		}
+
+		switch e.parser {
+		case parserRegex:
+			match := e.regex.FindStringSubmatch(text)
+			if match == nil {
+				continue
+			}
+			named := false
+			for i, group := range e.regex.SubexpNames() {
+				if i > 0 && group != "" {
+					fields[group] = match[i]
+					named = true
+				}
+			}
+			if e.name != "" && !named {
+				if len(match) > 1 {
+					fields[e.name] = match[1]
+				} else {
+					fields[e.name] = match[0]
+				}
+			}
+		case parserKeyValue:
+			for _, match := range keyValueRegex.FindAllStringSubmatch(text, -1) {
+				fields[match[1]] = match[2]
+			}
+		case parserJSON:
+			var decoded map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimSpace(text)), &decoded); err != nil {
+				log.Debug().Err(err).Msg("     Can't extract fields from JSON")
+				continue
+			}
+			flattenJSON("", decoded, fields)
+		}
+	}
+	return fields
+}
+
+/*
+flattenJSON stores every value of a JSON object as a string, naming nested values with dots such as "host.name"
+
+Parameters:
+
+	prefix  - The name of the object being flattened
+	decoded - The decoded object
+	fields  - Where to store the values
+*/
+func flattenJSON(prefix string, decoded map[string]interface{}, fields map[string]string) {
+	for key, value := range decoded {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenJSON(key, v, fields)
+		case string:
+			fields[key] = v
+		case nil:
+			fields[key] = ""
+		default:
+			b, _ := json.Marshal(v)
+			fields[key] = string(b)
+		}
+	}
+}
+
+/*
+checkFields determines if the fields extracted by the junction match its conditions
+
+Parameters:
+
+	juncFields - The values the extracted fields must have
+	fields     - The fields extracted from the email
+
+Returns:
+
+	bool       - Whether or not the conditions match
+*/
+func checkFields(juncFields map[string]string, fields map[string]string) bool {
+	log.Debug().Msg("   Checking 'fields' conditions")
+	// If there are no field conditions, match by default
+	if len(juncFields) == 0 {
+		log.Debug().Msg("     No condition provided, matches by default")
+		return true
+	}
+
+	for name, want := range juncFields {
+		got, ok := fields[name]
+		matched := ok && strings.EqualFold(got, want)
+		log.Debug().Str("field", name).Str("provided value", want).Str("received value", got).Bool("matches", matched).Msg("     ")
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestExtractFields(t *testing.T) {
+	email := EmailData{
+		Subject: "[nas01] Backup FAILED",
+		Body:    "Status: FAILED\nHost: nas01\nDuration=5m\n",
+	}
+	jsonEmail := EmailData{
+		Body: `{"status": "ok", "host": {"name": "nas01"}, "disks": 4}`,
+	}
+
+	var tests = []struct {
+		extracts []Extract
+		email    EmailData
+		result   map[string]string
+	}{
+		{nil, email, map[string]string{}},
+		{[]Extract{{Name: "result", Regex: `Backup (\w+)`, Source: "subject"}}, email, map[string]string{"result": "FAILED"}},
+		{[]Extract{{Regex: `^\[(?P<host>\w+)\] (?P<job>\w+)`, Source: "subject"}}, email, map[string]string{"host": "nas01", "job": "Backup"}},
+		{[]Extract{{Name: "missing", Regex: `Missing: (\w+)`}}, email, map[string]string{}},
+		{[]Extract{{Parser: "key-value"}}, email, map[string]string{"Status": "FAILED", "Host": "nas01", "Duration": "5m"}},
+		{[]Extract{{Parser: "json"}}, jsonEmail, map[string]string{"status": "ok", "host.name": "nas01", "disks": "4"}},
+		{[]Extract{{Parser: "json"}}, email, map[string]string{}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			extractors, err := parseExtracts(test.extracts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := extractFields(extractors, test.email)
+			if !reflect.DeepEqual(res, test.result) {
+				t.Errorf("received '%v', wanted '%v'", res, test.result)
+			}
+		})
+	}
+}
+
+func TestParseExtractsErrors(t *testing.T) {
+	var tests = [][]Extract{
+		{{Name: "bad", Regex: `(`}},
+		{{Regex: `no name`}},
+		{{Parser: "xml"}},
+		{{Parser: "json", Source: "header"}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseExtracts(test); err == nil {
+				t.Errorf("expected an error for %+v", test)
+			}
+		})
+	}
+}
+
+func TestCheckFields(t *testing.T) {
+	fields := map[string]string{"Status": "FAILED", "Host": "nas01"}
+
+	var tests = []struct {
+		juncFields map[string]string
+		result     bool
+	}{
+		{nil, true},
+		{map[string]string{"Status": "FAILED"}, true},
+		{map[string]string{"Status": "failed"}, true},
+		{map[string]string{"Status": "FAILED", "Host": "nas01"}, true},
+		{map[string]string{"Status": "OK"}, false},
+		{map[string]string{"Missing": ""}, false},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			res := checkFields(test.juncFields, fields)
+			if res != test.result {
+				t.Errorf("received '%t', wanted '%t'", res, test.result)
+			}
+		})
+	}
+}
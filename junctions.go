@@ -1,26 +1,105 @@
 package main
 
 import (
+	"fmt"
+	"text/template"
+	"time"
+
 	"github.com/rs/zerolog/log"
 )
 
 type Junction struct {
-	Name    string   `yaml:"name,omitempty"`
-	Apprise string   `yaml:"apprise"`
-	To      JuncTo   `yaml:"to,omitempty"`
-	From    JuncFrom `yaml:"from,omitempty"`
-	Title   string   `yaml:"title,omitempty"`
-	Body    string   `yaml:"body,omitempty"`
+	Name          string            `yaml:"name,omitempty"`
+	Action        string            `yaml:"action,omitempty"`
+	RejectMessage string            `yaml:"reject-message,omitempty"`
+	Apprise       string            `yaml:"apprise"`
+	Routes        map[string]string `yaml:"routes,omitempty"`
+	Relay         Relay             `yaml:"relay,omitempty"`
+	Webhook       Webhook           `yaml:"webhook,omitempty"`
+	Exec          Exec              `yaml:"exec,omitempty"`
+	To            JuncTo            `yaml:"to,omitempty"`
+	From          JuncFrom          `yaml:"from,omitempty"`
+	Title         string            `yaml:"title,omitempty"`
+	TitleTemplate string            `yaml:"title-template,omitempty"`
+	Body          string            `yaml:"body,omitempty"`
+	BodyTemplate  string            `yaml:"body-template,omitempty"`
+	Type          string            `yaml:"type,omitempty"`
+	Priority      string            `yaml:"priority,omitempty"`
+	RateLimit     RateLimit         `yaml:"rate-limit,omitempty"`
+	Dedupe        Dedupe            `yaml:"dedupe,omitempty"`
+	Digest        Digest            `yaml:"digest,omitempty"`
+	Schedule      Schedule          `yaml:"schedule,omitempty"`
+	QuietHours    Schedule          `yaml:"quiet-hours,omitempty"`
+	Extract       []Extract         `yaml:"extract,omitempty"`
+	Fields        map[string]string `yaml:"fields,omitempty"`
+
+	limiter    *limiter
+	deduper    *deduper
+	digester   *digester
+	schedule   *schedule
+	quietHours *quietHours
+	extractors []extractor
+
+	titleTemplate    *template.Template
+	bodyTemplate     *template.Template
+	appriseTemplate  *template.Template
+	typeTemplate     *template.Template
+	priorityTemplate *template.Template
+	execArgTemplates []*template.Template
+	execEnvTemplates map[string]*template.Template
 }
 
 type JuncTo struct {
 	Emails     []string `yaml:"emails"`
+	NotEmails  []string `yaml:"not-emails,omitempty"`
 	RequireAll bool     `yaml:"require-all,omitempty"`
+	MinMatch   int      `yaml:"min-match,omitempty"`
+	Exclusive  bool     `yaml:"exclusive,omitempty"`
+	Source     string   `yaml:"source,omitempty"`
+	Tag        string   `yaml:"tag,omitempty"`
 }
 
 type JuncFrom struct {
-	Email string `yaml:"email,omitempty"`
-	IP    string `yaml:"ip,omitempty"`
+	Email    string `yaml:"email,omitempty"`
+	IP       string `yaml:"ip,omitempty"`
+	NotEmail string `yaml:"not-email,omitempty"`
+	NotIP    string `yaml:"not-ip,omitempty"`
+	SPF      string `yaml:"spf,omitempty"`
+	DKIM     string `yaml:"dkim,omitempty"`
+	DMARC    string `yaml:"dmarc,omitempty"`
+	Source   string `yaml:"source,omitempty"`
+}
+
+/*
+junctionID gets the name of a junction for logs and metrics
+
+Parameters:
+
+	index  - The index of the junction
+
+Returns:
+
+	string - The junction's name, or its index if it has none
+*/
+func junctionID(index int) string {
+	if junctions[index].Name == "" {
+		return fmt.Sprint(index)
+	}
+	return junctions[index].Name
+}
+
+/*
+flushHeld sends every notification held by quiet hours and rate limits now, rather than waiting for them to allow it.
+Quiet hours are flushed first since what they release still passes through the rate limits.
+*/
+func flushHeld() {
+	for index := range junctions {
+		junctions[index].quietHours.flush()
+	}
+	for index := range junctions {
+		junctions[index].limiter.flush()
+	}
+	globalLimiter.flush()
 }
 
 /*
@@ -28,25 +107,27 @@ selectJunction determines which Junction should be used
 
 Parameters:
 
-	to   - The To field of the received email
-	from - The From field of the received email
-	ip        - The IP address that the email was sent from
+	email - The received email
 
 Returns:
 
 	int       - The index of the selected Junction
 */
-func selectJunction(to []string, from string, ip string) int {
-	for index, junction := range junctions {
+func selectJunction(email EmailData) int {
+	for index := range junctions {
+		junction := &junctions[index]
 		log.Debug().Int("junction index", index).Msg("Checking")
 
 		// Check if the to and from blocks provided satisify the junction conditions
-		toMatch := checkTo(junction.To, to)
-		fromMatch := checkFrom(junction.From, from, ip)
+		to := toAddresses(junction.To.Source, email)
+		toMatch := checkTo(junction.To, to) && checkTag(junction.To.Tag, to)
+		fromMatch := checkFrom(junction.From, fromAddress(junction.From.Source, email), email.IP) && checkAuthConditions(junction.From, email.Auth)
+		scheduleMatch := checkSchedule(junction.schedule, time.Now())
+		fieldsMatch := checkFields(junction.Fields, extractFields(junction.extractors, email))
 
-		log.Debug().Bool("to", toMatch).Bool("from", fromMatch).Msg("Results")
+		log.Debug().Bool("to", toMatch).Bool("from", fromMatch).Bool("schedule", scheduleMatch).Bool("fields", fieldsMatch).Msg("Results")
 
-		if toMatch && fromMatch {
+		if toMatch && fromMatch && scheduleMatch && fieldsMatch {
 			return index
 		}
 	}
@@ -67,6 +148,17 @@ Returns:
 	bool    - Whether or not the conditions match
 */
 func checkTo(juncTo JuncTo, email []string) bool {
+	log.Debug().Msg("   Checking 'to not-emails' condition")
+	// Any excluded recipient vetoes the match
+	for _, notEmail := range juncTo.NotEmails {
+		for _, toEmail := range email {
+			if normalizeAddress(notEmail) == normalizeAddress(toEmail) {
+				log.Debug().Str("excluded email", notEmail).Msg("     Excluded recipient present, 'to' doesn't match")
+				return false
+			}
+		}
+	}
+
 	log.Debug().Msg("   Checking 'to email' conditions")
 	// If there is no To block, match by default
 	if len(juncTo.Emails) == 0 {
@@ -74,27 +166,37 @@ func checkTo(juncTo JuncTo, email []string) bool {
 		return true
 	}
 
-	// Check each To value for a match
-	matches := make([]bool, len(juncTo.Emails))
-	for index, junctionEmail := range juncTo.Emails {
-		for _, toEmail := range email {
-			matched := junctionEmail == toEmail
+	// Count the listed emails that are present, and note which recipients are listed
+	matches := 0
+	listed := make([]bool, len(email))
+	for _, junctionEmail := range juncTo.Emails {
+		found := false
+		for index, toEmail := range email {
+			matched := normalizeAddress(junctionEmail) == normalizeAddress(toEmail)
 			log.Debug().Str("provided email", junctionEmail).Str("received email", toEmail).Bool("matches", matched).Msg("     ")
 			if matched {
-				if !juncTo.RequireAll || len(junctionEmail) == 1 {
-					log.Debug().Msg("     Only one match required, 'to' matches")
-					return true
-				}
-				matches[index] = true
+				found = true
+				listed[index] = true
 			}
 		}
+		if found {
+			matches++
+		}
+	}
+
+	required := requiredMatches(juncTo)
+	log.Debug().Int("required", required).Int("present", matches).Msg("     Making sure required emails are present")
+	if matches < required {
+		log.Debug().Msg("     Required emails not present, 'to' doesn't match")
+		return false
 	}
 
-	log.Debug().Msg("     Making sure required emails are present")
-	for index, match := range matches {
-		if !match {
-			log.Debug().Str("email", juncTo.Emails[index]).Msg("     Required emails not present, 'to' doesn't match")
-			return false
+	if juncTo.Exclusive {
+		for index, ok := range listed {
+			if !ok {
+				log.Debug().Str("email", email[index]).Msg("     Recipient not listed, 'to' doesn't match")
+				return false
+			}
 		}
 	}
 
@@ -102,6 +204,27 @@ func checkTo(juncTo JuncTo, email []string) bool {
 	return true
 }
 
+/*
+requiredMatches determines how many of the listed emails must be present
+
+Parameters:
+
+	juncTo - The 'To' block of the junction
+
+Returns:
+
+	int    - Every listed email with require-all, min-match if set, otherwise one
+*/
+func requiredMatches(juncTo JuncTo) int {
+	if juncTo.RequireAll {
+		return len(juncTo.Emails)
+	}
+	if juncTo.MinMatch > 0 {
+		return juncTo.MinMatch
+	}
+	return 1
+}
+
 /*
 checkFrom determines if the provided junction's 'From' field matches the received email
 
@@ -125,7 +248,7 @@ func checkFrom(juncFrom JuncFrom, email string, ip string) bool {
 		log.Debug().Msg("     No condition provided, matches by default")
 		emailMatched = true
 	} else {
-		emailMatched = email == juncFrom.Email
+		emailMatched = normalizeAddress(email) == normalizeAddress(juncFrom.Email)
 		log.Debug().Str("provided email", juncFrom.Email).Str("received email", email).Bool("matches", emailMatched).Msg("     ")
 	}
 
@@ -139,5 +262,16 @@ func checkFrom(juncFrom JuncFrom, email string, ip string) bool {
 		log.Debug().Str("provided ip", juncFrom.IP).Str("received ip", ip).Bool("matches", ipMatched).Msg("     ")
 	}
 
+	log.Debug().Msg("   Checking 'from not-email' and 'from not-ip' conditions")
+	// An excluded sender vetoes the match
+	if juncFrom.NotEmail != "" && normalizeAddress(email) == normalizeAddress(juncFrom.NotEmail) {
+		log.Debug().Str("excluded email", juncFrom.NotEmail).Msg("     Excluded sender, 'from' doesn't match")
+		return false
+	}
+	if juncFrom.NotIP != "" && ip == juncFrom.NotIP {
+		log.Debug().Str("excluded ip", juncFrom.NotIP).Msg("     Excluded IP, 'from' doesn't match")
+		return false
+	}
+
 	return emailMatched && ipMatched
 }
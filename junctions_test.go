@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -462,6 +463,35 @@ func TestCheckTo(t *testing.T) {
 		{testJuncs[15], testEmails[11], false},
 		{testJuncs[15], testEmails[12], false},
 		{testJuncs[15], testEmails[13], true},
+		// require-all with a single email
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com"}, RequireAll: true}}, testEmails[0], true},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com"}, RequireAll: true}}, testEmails[3], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com"}, RequireAll: true}}, testEmails[7], true},
+
+		// min-match
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com", "testto3@test.com"}, MinMatch: 2}}, testEmails[0], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com", "testto3@test.com"}, MinMatch: 2}}, testEmails[7], true},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com", "testto3@test.com"}, MinMatch: 2}}, testEmails[9], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com", "testto3@test.com"}, MinMatch: 2}}, EmailData{To: []string{"testto@test.com", "testtowrong@test.com", "testto3@test.com"}}, true},
+
+		// exclusive
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com"}, Exclusive: true}}, testEmails[0], true},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com"}, Exclusive: true}}, testEmails[7], true},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com"}, Exclusive: true}}, testEmails[8], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com"}, Exclusive: true}}, testEmails[9], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com"}, Exclusive: true, RequireAll: true}}, testEmails[0], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com", "testto2@test.com"}, Exclusive: true, RequireAll: true}}, testEmails[7], true},
+
+		// normalized addresses
+		{testJuncs[1], EmailData{To: []string{"testto@TEST.com"}}, true},
+		{testJuncs[1], EmailData{To: []string{`"Test" <testto@test.com>`}}, true},
+		{testJuncs[1], EmailData{To: []string{"TestTo@test.com"}}, false},
+
+		// Excluded recipients
+		{Junction{To: JuncTo{NotEmails: []string{"testto2@test.com"}}}, testEmails[0], true},
+		{Junction{To: JuncTo{NotEmails: []string{"testto2@test.com"}}}, testEmails[7], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com"}, NotEmails: []string{"testto2@test.com"}}}, testEmails[7], false},
+		{Junction{To: JuncTo{Emails: []string{"testto@test.com"}, NotEmails: []string{"testto2@test.com"}}}, testEmails[9], true},
 	}
 
 	for i, test := range tests {
@@ -720,6 +750,14 @@ func TestCheckFrom(t *testing.T) {
 		{testJuncs[15], testEmails[11], false},
 		{testJuncs[15], testEmails[12], false},
 		{testJuncs[15], testEmails[13], false},
+
+		// Excluded senders
+		{Junction{From: JuncFrom{IP: "1.1.1.1", NotEmail: "testfromwrong@test.com"}}, testEmails[0], true},
+		{Junction{From: JuncFrom{IP: "1.1.1.1", NotEmail: "testfromwrong@test.com"}}, testEmails[1], false},
+		{Junction{From: JuncFrom{NotEmail: "TestFromWrong@TEST.com"}}, EmailData{From: "TestFromWrong@test.com"}, false},
+		{Junction{From: JuncFrom{NotIP: "8.8.8.8"}}, testEmails[0], true},
+		{Junction{From: JuncFrom{NotIP: "8.8.8.8"}}, testEmails[2], false},
+		{Junction{From: JuncFrom{Email: "testfrom@test.com", NotIP: "8.8.8.8"}}, testEmails[2], false},
 	}
 
 	for i, test := range tests {
@@ -763,10 +801,51 @@ func TestSelectJunction(t *testing.T) {
 	for i, test := range tests {
 		name := fmt.Sprint(i)
 		t.Run(name, func(t *testing.T) {
-			res := selectJunction(test.email.To, test.email.From, test.email.IP)
+			res := selectJunction(test.email)
 			if res != test.result {
 				t.Errorf("received '%d', wanted '%d'", res, test.result)
 			}
 		})
 	}
 }
+
+func TestFlushHeld(t *testing.T) {
+	defer func(previous []Junction) { junctions = previous }(junctions)
+	defer func(previous *limiter) { globalLimiter = previous }(globalLimiter)
+
+	// Quiet hours all day, then one notification an hour through both limits
+	quiet, err := newQuietHours("test", Schedule{Timezone: "UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := newLimiter("test", RateLimit{Rate: 1, Per: time.Hour, Overflow: overflowHold})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalLimiter, err = newLimiter("global", RateLimit{Rate: 1, Per: time.Hour, Overflow: overflowSummarize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	junctions = []Junction{{quietHours: quiet, limiter: held}}
+
+	delivered, summarized := 0, 0
+	for i := 0; i < 3; i++ {
+		quiet.admit(func() {
+			held.admit("test", func() {
+				globalLimiter.admit("test", func() { delivered++ }, func(count int) { summarized += count })
+			}, nil)
+		})
+	}
+	if delivered != 0 {
+		t.Fatalf("received '%d' deliveries, wanted '%d' during quiet hours", delivered, 0)
+	}
+
+	// Everything held reaches the global limit, which summarizes what it can't send
+	flushHeld()
+	if delivered != 1 {
+		t.Errorf("received '%d' deliveries, wanted '%d'", delivered, 1)
+	}
+	if summarized != 2 {
+		t.Errorf("received '%d' summarized, wanted '%d'", summarized, 2)
+	}
+}
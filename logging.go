@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type LogFile struct {
+	Path       string `yaml:"path"`
+	MaxSize    int    `yaml:"max-size,omitempty"`
+	MaxBackups int    `yaml:"max-backups,omitempty"`
+	MaxAge     int    `yaml:"max-age,omitempty"`
+	Compress   bool   `yaml:"compress,omitempty"`
+}
+
+/*
+setupLogging configures the global logger's level, format and output
+
+Parameters:
+
+	level   - The minimum level to log (trace, debug, info, warn, error)
+	format  - The output format (console or json)
+	logFile - Optional file to write to instead of stdout, rotated by size
+
+Returns:
+
+	error   - Why the level or format is invalid, logging still goes to the console at info so it can be reported
+*/
+func setupLogging(level string, format string, logFile LogFile) error {
+	// Pick the output, rotating the log file if one is configured
+	var out io.Writer = os.Stdout
+	if logFile.Path != "" {
+		out = &lumberjack.Logger{
+			Filename:   logFile.Path,
+			MaxSize:    logFile.MaxSize,
+			MaxBackups: logFile.MaxBackups,
+			MaxAge:     logFile.MaxAge,
+			Compress:   logFile.Compress,
+		}
+	}
+
+	// Pick the format, only colouring the console
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	console := zerolog.New(zerolog.ConsoleWriter{Out: out, NoColor: out != os.Stdout}).With().Timestamp().Logger()
+	switch strings.ToLower(format) {
+	case "", "console":
+		log.Logger = console
+	case "json":
+		log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	default:
+		log.Logger = console
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	// Set the level, defaulting to info
+	if level != "" {
+		parsed, err := zerolog.ParseLevel(strings.ToLower(level))
+		if err != nil || parsed == zerolog.NoLevel {
+			return fmt.Errorf("unknown log level %q", level)
+		}
+		zerolog.SetGlobalLevel(parsed)
+	}
+	return nil
+}
+
+/*
+newMessageID creates a short random identifier used to correlate the log lines of a single email
+
+Returns:
+
+	string - The identifier
+*/
+func newMessageID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
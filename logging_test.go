@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer func(previous zerolog.Logger) { log.Logger = previous }(log.Logger)
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+
+	var tests = []struct {
+		level  string
+		format string
+		wanted zerolog.Level
+		err    bool
+	}{
+		{"", "", zerolog.InfoLevel, false},
+		{"debug", "console", zerolog.DebugLevel, false},
+		{"WARN", "JSON", zerolog.WarnLevel, false},
+		{"trace", "json", zerolog.TraceLevel, false},
+		{"loud", "json", zerolog.InfoLevel, true},
+		{"debug", "xml", zerolog.InfoLevel, true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			logFile := LogFile{Path: filepath.Join(t.TempDir(), "junction.log")}
+			err := setupLogging(test.level, test.format, logFile)
+			if (err != nil) != test.err {
+				t.Errorf("received '%v', wanted an error '%t'", err, test.err)
+			}
+			if received := zerolog.GlobalLevel(); received != test.wanted {
+				t.Errorf("received '%s', wanted '%s'", received, test.wanted)
+			}
+		})
+	}
+}
+
+func TestSetupLoggingOutput(t *testing.T) {
+	defer func(previous zerolog.Logger) { log.Logger = previous }(log.Logger)
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+
+	var tests = []struct {
+		format string
+		check  func(line string) error
+	}{
+		// One JSON object per line
+		{"json", func(line string) error {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				return err
+			}
+			if entry["level"] != "info" || entry["message"] != "Disk full" || entry["junction"] != "storage" {
+				return fmt.Errorf("received '%s'", line)
+			}
+			return nil
+		}},
+		// Console lines written to a file aren't coloured
+		{"console", func(line string) error {
+			if strings.Contains(line, "\x1b[") || !strings.Contains(line, "Disk full") || !strings.Contains(line, "junction=storage") {
+				return fmt.Errorf("received '%q'", line)
+			}
+			return nil
+		}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "junction.log")
+			if err := setupLogging("info", test.format, LogFile{Path: path}); err != nil {
+				t.Fatal(err)
+			}
+			log.Info().Str("junction", "storage").Msg("Disk full")
+			log.Debug().Msg("Below the level")
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("received '%d' lines, wanted '%d'", len(lines), 1)
+			}
+			if err := test.check(lines[0]); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
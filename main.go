@@ -1,6 +1,21 @@
 package main
 
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
 func main() {
 	getConf()
-	startServer()
+	startMetrics(metricsAddr)
+	watchTemplates(templateDir)
+	deliveries = startDeliveries(maxDeliveries, deliveryQueue, deliveryTimeout)
+
+	// Shut down gracefully when asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := startServer(ctx)
+	stop()
+	os.Exit(code)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	emailsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "emails_received_total",
+		Help:      "Emails received by the SMTP server.",
+	})
+	emailsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "emails_rejected_total",
+		Help:      "Emails refused by the SMTP server, by reason.",
+	}, []string{"reason"})
+	emailParseErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "emails_parse_errors_total",
+		Help:      "Emails that could not be parsed, which are still matched against the junctions.",
+	})
+	emailsUnmatched = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "emails_unmatched_total",
+		Help:      "Emails that did not match any junction.",
+	})
+	emailsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "emails_dropped_total",
+		Help:      "Emails matched by a junction that doesn't notify, by action.",
+	}, []string{"junction", "action"})
+	junctionMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "matches_total",
+		Help:      "Emails matched, by junction.",
+	}, []string{"junction"})
+	notificationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "notification_errors_total",
+		Help:      "Notifications that could not be built, by reason.",
+	}, []string{"reason"})
+	notificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "notifications_sent_total",
+		Help:      "Notifications delivered successfully, by backend.",
+	}, []string{"backend"})
+	notificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "notifications_failed_total",
+		Help:      "Notifications that failed to deliver, by backend.",
+	}, []string{"backend"})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "rate_limited_total",
+		Help:      "Notifications that exceeded a rate limit, by limiter and overflow behaviour.",
+	}, []string{"limiter", "overflow"})
+	duplicatesSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "junction",
+		Name:      "duplicates_suppressed_total",
+		Help:      "Emails suppressed as repeats of a recent email, by junction.",
+	}, []string{"junction"})
+	messageSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "junction",
+		Name:      "message_size_bytes",
+		Help:      "Size of received emails.",
+		Buckets:   prometheus.ExponentialBuckets(512, 4, 8),
+	})
+	parseDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "junction",
+		Name:      "parse_duration_seconds",
+		Help:      "Time taken to parse a received email.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+	notifyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "junction",
+		Name:      "notify_duration_seconds",
+		Help:      "Time taken to deliver a notification, by backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "junction",
+		Name:      "queue_depth",
+		Help:      "Notifications waiting to be delivered or currently being delivered.",
+	})
+)
+
+/*
+startMetrics serves the Prometheus metrics endpoint in the background
+
+Parameters:
+
+	addr - The address to listen on, metrics are disabled if empty
+*/
+func startMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Info().Str("address", addr).Msg("Serving metrics")
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error().Err(err).Msg("Error with the metrics server")
+		}
+	}()
+}
+
+/*
+backendName determines the label used for a notification URL in metrics
+
+Parameters:
+
+	appriseURL - The rendered Apprise URL
+
+Returns:
+
+	string     - The URL's scheme, or "unknown"
+*/
+func backendName(appriseURL string) string {
+	parsed, err := url.Parse(appriseURL)
+	if err != nil || parsed.Scheme == "" {
+		return "unknown"
+	}
+	return strings.ToLower(parsed.Scheme)
+}
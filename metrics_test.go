@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBackendName(t *testing.T) {
+	var tests = []struct {
+		url    string
+		wanted string
+	}{
+		{"ntfy://ntfy.sh/alerts", "ntfy"},
+		{"PBUL://token", "pbul"},
+		{"json://localhost:8000/path", "json"},
+		{"localhost", "unknown"},
+		{"", "unknown"},
+		{"://broken", "unknown"},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if received := backendName(test.url); received != test.wanted {
+				t.Errorf("received '%s', wanted '%s'", received, test.wanted)
+			}
+		})
+	}
+}
+
+func TestMailHandlerMetrics(t *testing.T) {
+	defer func(previous []Junction) { junctions = previous }(junctions)
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = nil
+
+	junctions = []Junction{
+		{Apprise: "json://localhost", Title: `{{ regexFind "(" .Subject }}`, To: JuncTo{Emails: []string{"broken@example.com"}}},
+		{Routes: map[string]string{"disk": "json://localhost"}, To: JuncTo{Emails: []string{"alerts+backup@example.com"}}},
+	}
+	for index := range junctions {
+		if err := junctions[index].compileTemplates(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		to          string
+		data        string
+		parseErrors float64
+		template    float64
+		route       float64
+	}{
+		// An unparsable email is still handled, not refused
+		{"nobody@example.com", "not an email", 1, 0, 0},
+		{"broken@example.com", "Subject: Disk full\r\n\r\nnas\r\n", 0, 1, 0},
+		{"alerts+backup@example.com", "Subject: Backup failed\r\n\r\nnas\r\n", 0, 0, 1},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			parseErrors := testutil.ToFloat64(emailParseErrors)
+			template := testutil.ToFloat64(notificationErrors.WithLabelValues("template"))
+			route := testutil.ToFloat64(notificationErrors.WithLabelValues("route"))
+			rejected := testutil.CollectAndCount(emailsRejected)
+
+			remoteAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+			if err := mailHandler(remoteAddr, "server@example.com", []string{test.to}, []byte(test.data)); err != nil {
+				t.Fatal(err)
+			}
+
+			if received := testutil.ToFloat64(emailParseErrors) - parseErrors; received != test.parseErrors {
+				t.Errorf("received '%v' parse errors, wanted '%v'", received, test.parseErrors)
+			}
+			if received := testutil.ToFloat64(notificationErrors.WithLabelValues("template")) - template; received != test.template {
+				t.Errorf("received '%v' template errors, wanted '%v'", received, test.template)
+			}
+			if received := testutil.ToFloat64(notificationErrors.WithLabelValues("route")) - route; received != test.route {
+				t.Errorf("received '%v' route errors, wanted '%v'", received, test.route)
+			}
+			if received := testutil.CollectAndCount(emailsRejected); received != rejected {
+				t.Errorf("received '%d' rejection reasons, wanted '%d'", received, rejected)
+			}
+		})
+	}
+}
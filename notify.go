@@ -1,88 +1,300 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/mail"
+	neturl "net/url"
 	"os/exec"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Notification is a rendered notification, ready to be sent
+type Notification struct {
+	Title    string
+	Body     string
+	URL      string
+	Type     string // One of Apprise's notification types, or empty for its default
+	Priority string // Passed to services that support a priority, or empty for their default
+}
+
+// errNoRoute is returned when a junction has routes, none for the email's tag, and no Apprise URL to fall back to
+var errNoRoute = errors.New("no route for the tag")
+
+// The notification types Apprise accepts
+var notificationTypes = map[string]bool{
+	"info":    true,
+	"success": true,
+	"warning": true,
+	"failure": true,
+}
+
+// TemplateData is the data available to a junction's templates
+type TemplateData struct {
+	Subject   string            // The received email's subject line
+	Body      string            // The received email's body
+	To        string            // The received email's to field preformatted
+	From      string            // The received email's from field
+	Date      string            // The date the received email was sent
+	IP        string            // The IP of the machine that sent the received email
+	RawTo     []string          // The raw slice of the email's to field
+	Headers   mail.Header       // Every header of the received email
+	MessageID string            // The received email's Message-ID header
+	Size      int               // The size of the raw email in bytes
+	Helo      string            // The name the sending machine gave in HELO/EHLO
+	Received  time.Time         // When the email was received
+	Fields    map[string]string // Values extracted from the email by the junction's extract section
+	Auth      AuthResults       // The results of the SPF, DKIM and DMARC checks, empty unless they ran
+	Tag       string            // The subaddress tag of the first recipient with one, such as "disk" for "alerts+disk@example.com"
+}
+
 /*
-buildMessage prepares the title and body of the notification
+newTemplateData prepares the data used by the templates
 
 Parameters:
 
-	email    - Data from the received email
-	junction - The Junction to send to
+	email - Data from the received email
 
 Returns:
 
-	title - The notification title
-	body  - The notification body
+	TemplateData - The data to execute templates with
 */
-func buildMessage(email EmailData, junction Junction) (title string, body string, url string) {
+func newTemplateData(email EmailData) TemplateData {
+	return TemplateData{
+		Subject:   email.Subject,
+		Body:      email.Body,
+		To:        strings.Join(email.To, ","),
+		From:      email.From,
+		Date:      email.Date,
+		IP:        email.IP,
+		RawTo:     email.To,
+		Headers:   email.Headers,
+		MessageID: email.MessageID,
+		Size:      email.Size,
+		Helo:      email.Helo,
+		Received:  email.Received,
+		Fields:    email.Fields,
+		Auth:      email.Auth,
+		Tag:       email.Tag,
+	}
+}
+
+/*
+compileTemplates parses the junction's templates once, so every email can reuse them
+
+Returns:
+
+	error - Why a template can't be parsed
+*/
+func (junction *Junction) compileTemplates() error {
+	templatesMu.RLock()
+	shared := sharedTemplates
+	templatesMu.RUnlock()
+
+	return junction.compileTemplatesWith(shared)
+}
+
+/*
+compileTemplatesWith parses the junction's templates against a specific set of shared templates
+
+Parameters:
+
+	shared - The shared templates the junction can reference, may be nil
+
+Returns:
+
+	error  - Why a template can't be parsed
+*/
+func (junction *Junction) compileTemplatesWith(shared *template.Template) error {
+	// Named templates are included by reference
+	reference := func(field string, text string, name string) (string, error) {
+		if name == "" {
+			return text, nil
+		}
+		if text != "" {
+			return "", fmt.Errorf("only one of %s and %s-template can be set", field, field)
+		}
+		if shared == nil || shared.Lookup(name) == nil {
+			return "", fmt.Errorf("%s-template %q does not exist", field, name)
+		}
+		return fmt.Sprintf("{{ template %q . }}", name), nil
+	}
+
+	title, err := reference("title", junction.Title, junction.TitleTemplate)
+	if err != nil {
+		return err
+	}
+	body, err := reference("body", junction.Body, junction.BodyTemplate)
+	if err != nil {
+		return err
+	}
+
+	junction.titleTemplate = nil
+	if title != "" {
+		if junction.titleTemplate, err = newTemplateWith(shared, "title", title); err != nil {
+			return err
+		}
+	}
+
+	junction.bodyTemplate = nil
+	if body != "" {
+		if junction.bodyTemplate, err = newTemplateWith(shared, "body", body); err != nil {
+			return err
+		}
+	}
+
+	junction.typeTemplate = nil
+	if junction.Type != "" {
+		if junction.typeTemplate, err = newTemplateWith(shared, "type", junction.Type); err != nil {
+			return err
+		}
+	}
+
+	junction.priorityTemplate = nil
+	if junction.Priority != "" {
+		if junction.priorityTemplate, err = newTemplateWith(shared, "priority", junction.Priority); err != nil {
+			return err
+		}
+	}
+
+	if err := junction.compileExec(shared); err != nil {
+		return err
+	}
+
+	junction.appriseTemplate, err = newTemplateWith(shared, "apprise", junction.Apprise)
+	return err
+}
+
+/*
+buildMessage prepares the notification for the received email
+
+Parameters:
+
+	email        - Data from the received email
+	junction     - The Junction to send to
+
+Returns:
+
+	Notification - The notification to send
+	error        - Why a template couldn't be executed
+*/
+func buildMessage(email EmailData, junction Junction) (Notification, error) {
 	// Prepare the data used by the Template
-	templateData := struct {
-		Subject string   // The received email's subject line
-		Body    string   // The received email's body
-		To      string   // The received email's to field preformatted
-		From    string   // The received email's from field
-		Date    string   // The date the received email was sent
-		IP      string   // The IP of the machine that sent the received email
-		RawTo   []string // The raw slice of the email's to field
-	}{
-		Subject: email.Subject,
-		Body:    email.Body,
-		To:      strings.Join(email.To, ","),
-		From:    email.From,
-		Date:    email.Date,
-		IP:      email.IP,
-		RawTo:   email.To,
-	}
-
-	// If the Junction provides a Title Template, parse it
-	// Else, use the Email Subject
-	if junction.Title != "" {
+	templateData := newTemplateData(email)
+
+	// Execute a template if the junction provides one, else use the fallback
+	render := func(template *template.Template, fallback string) (string, error) {
+		if template == nil {
+			return fallback, nil
+		}
 		builder := &strings.Builder{}
-		template, err := template.New("title").Parse(junction.Title)
-		if err != nil {
-			log.Error().Err(err).Msg("Can't parse the title")
+		if err := template.Execute(builder, templateData); err != nil {
+			return "", err
 		}
+		return builder.String(), nil
+	}
 
-		template.Execute(builder, templateData)
-		title = builder.String()
-	} else {
-		title = email.Subject
+	var notification Notification
+	var err error
+	if notification.Title, err = render(junction.titleTemplate, email.Subject); err != nil {
+		return notification, err
+	}
+	if notification.Body, err = render(junction.bodyTemplate, email.Body); err != nil {
+		return notification, err
+	}
+	if notification.URL, err = render(junction.appriseTemplate, junction.Apprise); err != nil {
+		return notification, err
 	}
 
-	// If the Junction provides a Body Template, parse it
-	// Else use the Email Body
-	if junction.Body != "" {
-		builder := &strings.Builder{}
-		template, err := template.New("body").Parse(junction.Body)
-		if err != nil {
-			log.Error().Err(err).Msg("Can't parse the body")
+	// A route for the recipient's tag replaces the junction's URL
+	if len(junction.Routes) > 0 {
+		if url, ok := lookupRoute(junction.Routes, email.Tag); ok {
+			notification.URL = url
+		} else if strings.TrimSpace(notification.URL) == "" {
+			return notification, fmt.Errorf("%w %q", errNoRoute, email.Tag)
 		}
+	}
+	if notification.Type, err = render(junction.typeTemplate, ""); err != nil {
+		return notification, err
+	}
+	if notification.Priority, err = render(junction.priorityTemplate, ""); err != nil {
+		return notification, err
+	}
 
-		template.Execute(builder, templateData)
-		body = builder.String()
-	} else {
-		body = email.Body
+	// Templates may render surrounding whitespace, and an unknown type would make Apprise fail
+	notification.Type = strings.ToLower(strings.TrimSpace(notification.Type))
+	notification.Priority = strings.TrimSpace(notification.Priority)
+	if notification.Type != "" && !notificationTypes[notification.Type] {
+		log.Warn().Str("type", notification.Type).Msg("Unknown notification type, using info")
+		notification.Type = "info"
 	}
 
-	// Build the URL template
-	builder := &strings.Builder{}
-	template, err := template.New("url").Parse(junction.Apprise)
-	if err != nil {
-		log.Error().Err(err).Msg("Can't parse the url")
+	return notification, nil
+}
+
+/*
+lookupRoute finds the Apprise URL for a subaddress tag
+
+Parameters:
+
+	routes - The junction's Apprise URLs by tag
+	tag    - The email's tag, compared without case
+
+Returns:
+
+	string - The Apprise URL
+	bool   - Whether the tag has a route
+*/
+func lookupRoute(routes map[string]string, tag string) (string, bool) {
+	if tag == "" {
+		return "", false
+	}
+	if url, ok := routes[tag]; ok {
+		return url, true
+	}
+	for route, url := range routes {
+		if strings.EqualFold(route, tag) {
+			return url, true
+		}
+	}
+	return "", false
+}
+
+/*
+appriseArgs builds the Apprise CLI arguments for a notification
+
+Parameters:
+
+	notification - The notification to send
+
+Returns:
+
+	[]string     - The arguments, not including the command itself
+*/
+func appriseArgs(notification Notification) []string {
+	args := []string{"-vv", "-t", notification.Title, "-b", notification.Body}
+	if notification.Type != "" {
+		args = append(args, "-n", notification.Type)
 	}
 
-	template.Execute(builder, templateData)
-	url = builder.String()
+	// Apprise has no generic priority option, services that support one read it from the URL
+	url := notification.URL
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	url = fmt.Sprintf("%s%soverflow=split", url, separator)
+	if notification.Priority != "" && !strings.Contains(notification.URL, "priority=") {
+		url = fmt.Sprintf("%s&priority=%s", url, neturl.QueryEscape(notification.Priority))
+	}
 
-	return
+	return append(args, url)
 }
 
 /*
@@ -90,17 +302,27 @@ sendNotification sends the notification using the Apprise CLI
 
 Parameters:
 
-	title      - The Title string
-	body       - The Body string
-	appriseURL - The Apprise URL to send to
+	ctx          - Carries the logger for the email being delivered, and the delivery's deadline
+	notification - The notification to send
 */
-func sendNotification(title string, body string, appriseURL string) {
-	apprise := exec.Command(apprisePath)
-	apprise.Args = append(apprise.Args, "-vv", "-t", title, "-b", body, fmt.Sprintf("%s?overflow=split", appriseURL))
-	result, err := apprise.Output()
+func sendNotification(ctx context.Context, notification Notification) {
+	logger := zerolog.Ctx(ctx)
+	backend := backendName(notification.URL)
+
+	// The context's deadline kills Apprise if it hangs
+	start := time.Now()
+	apprise := exec.CommandContext(ctx, apprisePath)
+	apprise.Args = append(apprise.Args, appriseArgs(notification)...)
+	apprise.WaitDelay = time.Second
+	result, err := apprise.CombinedOutput()
+	notifyDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	logger.Debug().Str("output", strings.TrimSpace(string(result))).Msg("Apprise output")
 	if err != nil {
-		log.Error().Err(err).Msg("Apprise returned an error")
+		notificationsFailed.WithLabelValues(backend).Inc()
+		logger.Error().Err(err).Str("backend", backend).Str("status", "failed").Msg("Apprise returned an error")
+		return
 	}
 
-	log.Print(string(result))
+	notificationsSent.WithLabelValues(backend).Inc()
+	logger.Info().Str("backend", backend).Str("status", "delivered").Msg("Notification sent")
 }
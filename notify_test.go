@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTypeAndPriority(t *testing.T) {
+	var tests = []struct {
+		junction Junction
+		subject  string
+		nType    string
+		priority string
+	}{
+		{Junction{Apprise: "json://localhost"}, "Backup done", "", ""},
+		{Junction{Apprise: "json://localhost", Type: "warning", Priority: "high"}, "Backup done", "warning", "high"},
+		{Junction{Apprise: "json://localhost", Type: `{{ if regexFind "(?i)fail" .Subject }}failure{{ else }}success{{ end }}`}, "Backup FAILED", "failure", ""},
+		{Junction{Apprise: "json://localhost", Type: `{{ if regexFind "(?i)fail" .Subject }}failure{{ else }}success{{ end }}`}, "Backup done", "success", ""},
+		{Junction{Apprise: "json://localhost", Type: " Failure\n"}, "Backup done", "failure", ""},
+		{Junction{Apprise: "json://localhost", Type: "urgent"}, "Backup done", "info", ""},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if err := test.junction.compileTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			n, err := buildMessage(EmailData{Subject: test.subject}, test.junction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Type != test.nType || n.Priority != test.priority {
+				t.Errorf("received '%s', '%s', wanted '%s', '%s'", n.Type, n.Priority, test.nType, test.priority)
+			}
+		})
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	junction := Junction{
+		Apprise: "ntfy://localhost/{{ .Tag }}",
+		Routes: map[string]string{
+			"discord-ops": "discord://ops",
+			"Pager":       "pagerduty://key",
+		},
+	}
+	if err := junction.compileTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		tag string
+		url string
+	}{
+		{"discord-ops", "discord://ops"},
+		{"pager", "pagerduty://key"},
+		{"backups", "ntfy://localhost/backups"},
+		{"", "ntfy://localhost/"},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			n, err := buildMessage(EmailData{Tag: test.tag}, junction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.URL != test.url {
+				t.Errorf("received '%s', wanted '%s'", n.URL, test.url)
+			}
+		})
+	}
+}
+
+func TestAppriseArgs(t *testing.T) {
+	var tests = []struct {
+		notification Notification
+		result       []string
+	}{
+		{
+			Notification{Title: "t", Body: "b", URL: "json://localhost"},
+			[]string{"-vv", "-t", "t", "-b", "b", "json://localhost?overflow=split"},
+		},
+		{
+			Notification{Title: "t", Body: "b", URL: "ntfy://topic?tags=x", Type: "failure", Priority: "max"},
+			[]string{"-vv", "-t", "t", "-b", "b", "-n", "failure", "ntfy://topic?tags=x&overflow=split&priority=max"},
+		},
+		{
+			Notification{Title: "t", Body: "b", URL: "pover://u@t?priority=emergency", Priority: "low"},
+			[]string{"-vv", "-t", "t", "-b", "b", "pover://u@t?priority=emergency&overflow=split"},
+		},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			res := appriseArgs(test.notification)
+			if !reflect.DeepEqual(res, test.result) {
+				t.Errorf("received '%v', wanted '%v'", res, test.result)
+			}
+		})
+	}
+}
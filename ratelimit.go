@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type RateLimit struct {
+	Rate     int           `yaml:"rate"`
+	Per      time.Duration `yaml:"per,omitempty"`
+	Burst    int           `yaml:"burst,omitempty"`
+	Overflow string        `yaml:"overflow,omitempty"`
+	MaxHeld  int           `yaml:"max-held,omitempty"`
+}
+
+// What happens to a notification once a limit is exceeded
+const (
+	overflowDrop      = "drop"
+	overflowHold      = "hold"
+	overflowSummarize = "summarize"
+)
+
+// How many notifications a hold limiter keeps before summarizing the rest
+const defaultMaxHeld = 100
+
+// limiter is a token bucket shared by every email passing through it
+type limiter struct {
+	mu         sync.Mutex
+	name       string
+	rate       float64 // Tokens added per second
+	burst      float64
+	tokens     float64
+	last       time.Time
+	window     time.Duration
+	overflow   string
+	maxHeld    int
+	held       []func()
+	drain      *time.Timer
+	suppressed map[string]*suppression
+}
+
+// suppression tracks the notifications rolled up for one junction until the window closes
+type suppression struct {
+	count   int
+	summary func(count int)
+}
+
+/*
+newLimiter creates a token bucket from a rate limit configuration
+
+Parameters:
+
+	name      - Used to identify the limiter in logs and metrics
+	rateLimit - The configured limit
+
+Returns:
+
+	*limiter  - The limiter, or nil if no limit is configured
+	error     - Why the limit is invalid
+*/
+func newLimiter(name string, rateLimit RateLimit) (*limiter, error) {
+	if rateLimit.Rate <= 0 {
+		return nil, nil
+	}
+
+	per := rateLimit.Per
+	if per <= 0 {
+		per = time.Minute
+	}
+	burst := rateLimit.Burst
+	if burst <= 0 {
+		burst = rateLimit.Rate
+	}
+
+	overflow := rateLimit.Overflow
+	switch overflow {
+	case "":
+		overflow = overflowDrop
+	case overflowDrop, overflowHold, overflowSummarize:
+	default:
+		return nil, fmt.Errorf("unknown rate limit overflow %q", overflow)
+	}
+
+	maxHeld := rateLimit.MaxHeld
+	if maxHeld <= 0 {
+		maxHeld = defaultMaxHeld
+	}
+
+	return &limiter{
+		name:       name,
+		rate:       float64(rateLimit.Rate) / per.Seconds(),
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		last:       time.Now(),
+		window:     per,
+		overflow:   overflow,
+		maxHeld:    maxHeld,
+		suppressed: map[string]*suppression{},
+	}, nil
+}
+
+/*
+take refills the bucket and consumes a token if one is available. The caller must hold the lock.
+
+Returns:
+
+	bool - Whether a token was consumed
+*/
+func (l *limiter) take() bool {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+/*
+admit runs the delivery if the limit allows it, otherwise applies the overflow behaviour
+
+Parameters:
+
+	junction - The name of the junction the notification is for
+	deliver  - Sends the notification
+	summary  - Sends a notification saying how many were suppressed
+*/
+func (l *limiter) admit(junction string, deliver func(), summary func(count int)) {
+	// No limit configured
+	if l == nil {
+		deliver()
+		return
+	}
+
+	l.mu.Lock()
+	if l.take() {
+		l.mu.Unlock()
+		deliver()
+		return
+	}
+	defer l.mu.Unlock()
+
+	rateLimited.WithLabelValues(l.name, l.overflow).Inc()
+	log.Warn().Str("limiter", l.name).Str("junction", junction).Str("overflow", l.overflow).Msg("Rate limit exceeded")
+
+	switch l.overflow {
+	case overflowHold:
+		if len(l.held) < l.maxHeld {
+			l.held = append(l.held, deliver)
+			l.scheduleDrain()
+			return
+		}
+		// Too many held already, roll the rest up rather than hold them all
+		log.Warn().Str("limiter", l.name).Str("junction", junction).Int("held", len(l.held)).Msg("Too many notifications held, summarizing")
+		l.suppress(junction, summary)
+	case overflowSummarize:
+		l.suppress(junction, summary)
+	}
+}
+
+/*
+suppress counts a notification towards the junction's summary, sent once the window closes. The caller must hold the lock.
+
+Parameters:
+
+	junction - The name of the junction the notification is for
+	summary  - Sends a notification saying how many were suppressed
+*/
+func (l *limiter) suppress(junction string, summary func(count int)) {
+	s, ok := l.suppressed[junction]
+	if !ok {
+		s = &suppression{}
+		l.suppressed[junction] = s
+		time.AfterFunc(l.window, func() { l.flushSummary(junction) })
+	}
+	s.count++
+	s.summary = summary
+}
+
+/*
+scheduleDrain releases held notifications once enough tokens are available. The caller must hold the lock.
+*/
+func (l *limiter) scheduleDrain() {
+	if l.drain != nil {
+		return
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	l.drain = time.AfterFunc(wait, func() {
+		l.mu.Lock()
+		l.drain = nil
+		var ready []func()
+		for len(l.held) > 0 && l.take() {
+			ready = append(ready, l.held[0])
+			l.held = l.held[1:]
+		}
+		if len(l.held) > 0 {
+			l.scheduleDrain()
+		}
+		l.mu.Unlock()
+
+		for _, deliver := range ready {
+			deliver()
+		}
+	})
+}
+
+/*
+flushSummary sends the rolled up summary for a junction once its window closes
+
+Parameters:
+
+	junction - The name of the junction to summarize
+*/
+func (l *limiter) flushSummary(junction string) {
+	l.mu.Lock()
+	s := l.suppressed[junction]
+	delete(l.suppressed, junction)
+	l.mu.Unlock()
+
+	if s != nil && s.count > 0 {
+		s.summary(s.count)
+	}
+}
+
+/*
+flush sends every held notification and pending summary now, rather than waiting for the limit to allow them
+*/
+func (l *limiter) flush() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	held := l.held
+	l.held = nil
+	if l.drain != nil {
+		l.drain.Stop()
+		l.drain = nil
+	}
+	suppressed := l.suppressed
+	l.suppressed = map[string]*suppression{}
+	l.mu.Unlock()
+
+	if len(held) > 0 {
+		log.Info().Str("limiter", l.name).Int("notifications", len(held)).Msg("Sending notifications held by the rate limit")
+	}
+	for _, deliver := range held {
+		deliver()
+	}
+	for _, s := range suppressed {
+		if s.count > 0 {
+			s.summary(s.count)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLimiterDrop(t *testing.T) {
+	l, err := newLimiter("test", RateLimit{Rate: 2, Per: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := 0
+	for i := 0; i < 5; i++ {
+		l.admit("test", func() { delivered++ }, func(int) { t.Error("summary sent when dropping") })
+	}
+
+	if delivered != 2 {
+		t.Errorf("got %d deliveries, wanted 2", delivered)
+	}
+}
+
+func TestLimiterSummarize(t *testing.T) {
+	l, err := newLimiter("test", RateLimit{Rate: 1, Per: 50 * time.Millisecond, Overflow: overflowSummarize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summarized := make(chan int, 1)
+	delivered := 0
+	for i := 0; i < 4; i++ {
+		l.admit("test", func() { delivered++ }, func(count int) { summarized <- count })
+	}
+
+	if delivered != 1 {
+		t.Errorf("got %d deliveries, wanted 1", delivered)
+	}
+
+	select {
+	case count := <-summarized:
+		if count != 3 {
+			t.Errorf("got a summary of %d, wanted 3", count)
+		}
+	case <-time.After(time.Second):
+		t.Error("summary was never sent")
+	}
+}
+
+func TestLimiterHold(t *testing.T) {
+	l, err := newLimiter("test", RateLimit{Rate: 1, Per: 20 * time.Millisecond, Overflow: overflowHold})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		l.admit("test", func() { delivered <- i }, func(int) { t.Error("summary sent when holding") })
+	}
+
+	for want := 0; want < 3; want++ {
+		select {
+		case got := <-delivered:
+			if got != want {
+				t.Errorf("got delivery %d, wanted %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d was never released", want)
+		}
+	}
+}
+
+func TestLimiterMaxHeld(t *testing.T) {
+	l, err := newLimiter("test", RateLimit{Rate: 1, Per: 50 * time.Millisecond, Overflow: overflowHold, MaxHeld: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One is sent, two are held and the rest are summarized
+	delivered := make(chan int, 5)
+	summaries := make(chan int, 1)
+	for i := 0; i < 5; i++ {
+		i := i
+		l.admit("test", func() { delivered <- i }, func(count int) { summaries <- count })
+	}
+
+	for want := 0; want < 3; want++ {
+		select {
+		case got := <-delivered:
+			if got != want {
+				t.Errorf("got delivery %d, wanted %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d was never released", want)
+		}
+	}
+	select {
+	case count := <-summaries:
+		if count != 2 {
+			t.Errorf("received '%d', wanted '%d'", count, 2)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("summary was never sent")
+	}
+	select {
+	case got := <-delivered:
+		t.Errorf("got delivery %d, wanted it summarized", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLimiterNil(t *testing.T) {
+	l, err := newLimiter("test", RateLimit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := false
+	l.admit("test", func() { delivered = true }, nil)
+
+	if !delivered {
+		t.Error("an unconfigured limiter should always deliver")
+	}
+}
+
+func TestLimiterOverflowError(t *testing.T) {
+	var tests = []struct {
+		overflow string
+		err      bool
+	}{
+		{"", false},
+		{overflowDrop, false},
+		{overflowHold, false},
+		{overflowSummarize, false},
+		{"queue", true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			_, err := newLimiter("test", RateLimit{Rate: 1, Overflow: test.overflow})
+			if (err != nil) != test.err {
+				t.Errorf("received '%v', wanted an error '%t'", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type Relay struct {
+	Server             string        `yaml:"server,omitempty"`
+	Username           string        `yaml:"username,omitempty"`
+	Password           string        `yaml:"password,omitempty"`
+	TLS                string        `yaml:"tls,omitempty"`
+	InsecureSkipVerify bool          `yaml:"insecure-skip-verify,omitempty"`
+	From               string        `yaml:"from,omitempty"`
+	To                 []string      `yaml:"to,omitempty"`
+	Mode               string        `yaml:"mode,omitempty"`
+	Timeout            time.Duration `yaml:"timeout,omitempty"`
+}
+
+// How the connection to the upstream server is secured
+const (
+	relayTLSAuto     = "auto"     // STARTTLS if the server offers it
+	relayTLSStartTLS = "starttls" // STARTTLS, failing if the server doesn't offer it
+	relayTLSImplicit = "tls"      // TLS from the start, usually on port 465
+	relayTLSNone     = "none"     // Never encrypt
+)
+
+// What is relayed
+const (
+	relayModeRaw      = "raw"      // The received email, untouched
+	relayModeRendered = "rendered" // A new email with the notification's title and body
+)
+
+// The time a relay can take when the config doesn't set one
+const defaultRelayTimeout = 30 * time.Second
+
+/*
+checkRelay validates the junction's relay
+
+Returns:
+
+	error - Why the relay is invalid
+*/
+func (junction *Junction) checkRelay() error {
+	relay := junction.Relay
+	if relay.Server == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(relay.Server); err != nil {
+		return fmt.Errorf("relay server: %w", err)
+	}
+	if len(relay.To) == 0 {
+		return errors.New("relay needs at least one to address")
+	}
+	switch relay.TLS {
+	case "", relayTLSAuto, relayTLSStartTLS, relayTLSImplicit, relayTLSNone:
+	default:
+		return fmt.Errorf("unknown relay tls %q", relay.TLS)
+	}
+	switch relay.Mode {
+	case "", relayModeRaw, relayModeRendered:
+	default:
+		return fmt.Errorf("unknown relay mode %q", relay.Mode)
+	}
+	return nil
+}
+
+/*
+relayMessage builds the email sent to the upstream server
+
+Parameters:
+
+	relay        - The junction's relay
+	email        - The received email
+	raw          - The raw received email
+	notification - The rendered notification
+
+Returns:
+
+	[]byte       - The email to send
+*/
+func relayMessage(relay Relay, email EmailData, raw []byte, notification Notification) []byte {
+	if relay.Mode != relayModeRendered {
+		return raw
+	}
+
+	from := relay.From
+	if from == "" {
+		from = email.From
+	}
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "From: %s\r\n", from)
+	fmt.Fprintf(builder, "To: %s\r\n", strings.Join(relay.To, ", "))
+	fmt.Fprintf(builder, "Subject: %s\r\n", relaySubject(notification.Title))
+	fmt.Fprintf(builder, "Date: %s\r\n", email.Received.Format(time.RFC1123Z))
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	builder.WriteString(strings.ReplaceAll(strings.ReplaceAll(notification.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(builder.String())
+}
+
+// Line breaks that would end the Subject header and start another
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+/*
+relaySubject makes a notification's title safe to use as a Subject header
+
+Parameters:
+
+	title  - The rendered title
+
+Returns:
+
+	string - The title on one line, encoded if it isn't plain ASCII
+*/
+func relaySubject(title string) string {
+	return mime.QEncoding.Encode("utf-8", lineBreaks.Replace(title))
+}
+
+/*
+sendRelay forwards an email through the upstream SMTP server, recording it like a notification
+
+Parameters:
+
+	ctx    - Carries the logger for the email being delivered, and the delivery's deadline
+	relay  - The junction's relay
+	from   - The envelope sender
+	msg    - The email to send
+*/
+func sendRelay(ctx context.Context, relay Relay, from string, msg []byte) {
+	logger := zerolog.Ctx(ctx)
+	const backend = "relay"
+
+	timeout := relay.Timeout
+	if timeout <= 0 {
+		timeout = defaultRelayTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if relay.From != "" {
+		from = relay.From
+	}
+
+	start := time.Now()
+	err := relayEmail(ctx, relay, from, msg)
+	notifyDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+	if err != nil {
+		notificationsFailed.WithLabelValues(backend).Inc()
+		logger.Error().Err(err).Str("backend", backend).Str("server", relay.Server).Str("status", "failed").Msg("Can't relay the email")
+		return
+	}
+
+	notificationsSent.WithLabelValues(backend).Inc()
+	logger.Info().Str("backend", backend).Str("server", relay.Server).Str("status", "delivered").Msg("Email relayed")
+}
+
+/*
+relayEmail sends an email through an SMTP server
+
+Parameters:
+
+	ctx   - Closes the connection when done
+	relay - The server and how to connect to it
+	from  - The envelope sender
+	msg   - The email to send
+
+Returns:
+
+	error - Why the email can't be sent
+*/
+func relayEmail(ctx context.Context, relay Relay, from string, msg []byte) error {
+	host, _, _ := net.SplitHostPort(relay.Server)
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: relay.InsecureSkipVerify}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", relay.Server)
+	if err != nil {
+		return err
+	}
+	if relay.TLS == relayTLSImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	// net/smtp has no context support, so close the connection if it runs out of time
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if relay.TLS != relayTLSImplicit && relay.TLS != relayTLSNone {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if relay.TLS == relayTLSStartTLS {
+			return errors.New("server doesn't support STARTTLS")
+		}
+	}
+
+	if relay.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", relay.Username, relay.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, to := range relay.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(msg); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
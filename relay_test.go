@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+// relayed is an email received by the stand-in upstream server
+type relayed struct {
+	from string
+	to   []string
+	data string
+}
+
+/*
+startUpstream starts a local SMTP server standing in for the upstream relay
+
+Returns:
+
+	string       - The server's address
+	chan relayed - Receives every email the server is sent
+*/
+func startUpstream(t *testing.T) (string, chan relayed) {
+	received := make(chan relayed, 1)
+	srv := &smtpd.Server{
+		Hostname: "upstream.test",
+		Handler: func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+			received <- relayed{from, to, string(data)}
+			return nil
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		ln.Close()
+	})
+	return ln.Addr().String(), received
+}
+
+func TestRelayEmail(t *testing.T) {
+	addr, received := startUpstream(t)
+	raw := []byte("From: server@example.com\r\nSubject: Backup done\r\n\r\nAll good\r\n")
+	email := EmailData{From: "server@example.com", Received: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	notification := Notification{Title: "BACKUP DONE", Body: "It worked"}
+
+	var tests = []struct {
+		relay    Relay
+		from     string
+		contains []string
+	}{
+		{Relay{Server: addr, To: []string{"me@example.com"}}, "server@example.com", []string{"Subject: Backup done", "All good"}},
+		{Relay{Server: addr, To: []string{"me@example.com", "you@example.com"}, From: "junction@example.com", Mode: relayModeRendered}, "junction@example.com", []string{"From: junction@example.com", "To: me@example.com, you@example.com", "Subject: BACKUP DONE", "It worked"}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			msg := relayMessage(test.relay, email, raw, notification)
+			from := email.From
+			if test.relay.From != "" {
+				from = test.relay.From
+			}
+			if err := relayEmail(context.Background(), test.relay, from, msg); err != nil {
+				t.Fatal(err)
+			}
+
+			got := <-received
+			if got.from != test.from {
+				t.Errorf("received '%s', wanted '%s'", got.from, test.from)
+			}
+			if fmt.Sprint(got.to) != fmt.Sprint(test.relay.To) {
+				t.Errorf("received '%v', wanted '%v'", got.to, test.relay.To)
+			}
+			for _, want := range test.contains {
+				if !strings.Contains(got.data, want) {
+					t.Errorf("received '%s', wanted it to contain '%s'", got.data, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRelaySubject(t *testing.T) {
+	var tests = []struct {
+		title   string
+		subject string
+	}{
+		{"BACKUP DONE", "BACKUP DONE"},
+		{"Disk full\nBcc: victim@example.com", "Disk full Bcc: victim@example.com"},
+		{"Disk full\rBcc: victim@example.com", "Disk full Bcc: victim@example.com"},
+		{"Disk full\r\nBcc: victim@example.com", "Disk full Bcc: victim@example.com"},
+		{"Sauvegarde réussie", "=?utf-8?q?Sauvegarde_r=C3=A9ussie?="},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			subject := relaySubject(test.title)
+			if subject != test.subject {
+				t.Errorf("received '%s', wanted '%s'", subject, test.subject)
+			}
+
+			// Only the one Subject header ends up in the email
+			msg := string(relayMessage(Relay{To: []string{"me@example.com"}, Mode: relayModeRendered}, EmailData{From: "server@example.com"}, nil, Notification{Title: test.title}))
+			headers, _, _ := strings.Cut(msg, "\r\n\r\n")
+			if strings.Contains(headers, "\nBcc:") || strings.Contains(headers, "\rBcc:") {
+				t.Errorf("received '%s', wanted no injected header", headers)
+			}
+		})
+	}
+}
+
+func TestRelayEmailRequiresStartTLS(t *testing.T) {
+	addr, _ := startUpstream(t)
+	relay := Relay{Server: addr, To: []string{"me@example.com"}, TLS: relayTLSStartTLS}
+	if err := relayEmail(context.Background(), relay, "server@example.com", []byte("Subject: hi\r\n\r\nbody\r\n")); err == nil {
+		t.Errorf("received no error, wanted one")
+	}
+}
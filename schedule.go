@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Schedule struct {
+	Timezone string   `yaml:"timezone,omitempty"`
+	Days     []string `yaml:"days,omitempty"`
+	Times    []string `yaml:"times,omitempty"`
+}
+
+// schedule is a parsed Schedule
+type schedule struct {
+	location *time.Location
+	days     map[time.Weekday]bool // Empty means every day
+	ranges   []timeRange           // Empty means all day
+}
+
+// timeRange is a span of the day in minutes after midnight, wrapping past midnight if end <= start
+type timeRange struct {
+	start int
+	end   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+/*
+parseSchedule validates a schedule and prepares it for checking
+
+Parameters:
+
+	s         - The configured schedule
+
+Returns:
+
+	*schedule - The parsed schedule, or nil if no conditions are configured
+	error     - Why the schedule is invalid
+*/
+func parseSchedule(s Schedule) (*schedule, error) {
+	if s.Timezone == "" && len(s.Days) == 0 && len(s.Times) == 0 {
+		return nil, nil
+	}
+
+	parsed := &schedule{
+		location: time.Local,
+		days:     map[time.Weekday]bool{},
+	}
+
+	if s.Timezone != "" {
+		location, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		parsed.location = location
+	}
+
+	for _, day := range s.Days {
+		name := strings.ToLower(strings.TrimSpace(day))
+		if len(name) < 3 {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+		weekday, ok := weekdays[name[:3]]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", day)
+		}
+		parsed.days[weekday] = true
+	}
+
+	for _, span := range s.Times {
+		start, end, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("time range %q must be formatted as HH:MM-HH:MM", span)
+		}
+		startTime, err := time.Parse("15:04", strings.TrimSpace(start))
+		if err != nil {
+			return nil, fmt.Errorf("time range %q must be formatted as HH:MM-HH:MM", span)
+		}
+		endTime, err := time.Parse("15:04", strings.TrimSpace(end))
+		if err != nil {
+			return nil, fmt.Errorf("time range %q must be formatted as HH:MM-HH:MM", span)
+		}
+		parsed.ranges = append(parsed.ranges, timeRange{
+			start: startTime.Hour()*60 + startTime.Minute(),
+			end:   endTime.Hour()*60 + endTime.Minute(),
+		})
+	}
+
+	return parsed, nil
+}
+
+/*
+checkSchedule determines if the provided time falls within the junction's schedule
+
+Parameters:
+
+	s    - The parsed schedule, matches by default if nil
+	now  - The time to check
+
+Returns:
+
+	bool - Whether or not the conditions match
+*/
+func checkSchedule(s *schedule, now time.Time) bool {
+	log.Debug().Msg("   Checking 'schedule' conditions")
+	if s == nil {
+		log.Debug().Msg("     No condition provided, matches by default")
+		return true
+	}
+
+	matched := s.contains(now)
+	log.Debug().Str("time", now.In(s.location).Format("Mon 15:04")).Bool("matches", matched).Msg("     ")
+	return matched
+}
+
+/*
+contains determines if the provided time falls within the schedule
+
+Parameters:
+
+	now  - The time to check
+
+Returns:
+
+	bool - Whether the time is within the schedule
+*/
+func (s *schedule) contains(now time.Time) bool {
+	now = now.In(s.location)
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	yesterday := (day + 6) % 7
+
+	dayMatches := func(weekday time.Weekday) bool {
+		return len(s.days) == 0 || s.days[weekday]
+	}
+
+	if len(s.ranges) == 0 {
+		return dayMatches(day)
+	}
+
+	for _, r := range s.ranges {
+		if r.start < r.end {
+			if dayMatches(day) && minute >= r.start && minute < r.end {
+				return true
+			}
+		} else if (dayMatches(day) && minute >= r.start) || (dayMatches(yesterday) && minute < r.end) {
+			// The range wraps past midnight, the early hours belong to the previous day's range
+			return true
+		}
+	}
+	return false
+}
+
+/*
+scheduleEnd finds when the schedule next stops matching
+
+Parameters:
+
+	s         - The parsed schedule
+	now       - The time to search from
+
+Returns:
+
+	time.Time - The first minute after now that falls outside of the schedule
+*/
+func scheduleEnd(s *schedule, now time.Time) time.Time {
+	end := now.Truncate(time.Minute).Add(time.Minute)
+	for limit := end.Add(8 * 24 * time.Hour); end.Before(limit); end = end.Add(time.Minute) {
+		if !s.contains(end) {
+			return end
+		}
+	}
+	return end
+}
+
+// quietHours holds a junction's notifications while its quiet hours are active
+type quietHours struct {
+	mu       sync.Mutex
+	junction string
+	schedule *schedule
+	held     []func()
+	timer    *time.Timer
+}
+
+/*
+newQuietHours creates the quiet hours for a junction
+
+Parameters:
+
+	junction    - The name of the junction
+	s           - The junction's quiet hours
+
+Returns:
+
+	*quietHours - The quiet hours, or nil if none are configured
+	error       - Why the quiet hours can't be parsed
+*/
+func newQuietHours(junction string, s Schedule) (*quietHours, error) {
+	parsed, err := parseSchedule(s)
+	if err != nil || parsed == nil {
+		return nil, err
+	}
+
+	return &quietHours{
+		junction: junction,
+		schedule: parsed,
+	}, nil
+}
+
+/*
+admit runs the delivery unless quiet hours are active, in which case it is held until they end
+
+Parameters:
+
+	deliver - Sends the notification
+*/
+func (q *quietHours) admit(deliver func()) {
+	if q == nil {
+		deliver()
+		return
+	}
+
+	now := time.Now()
+	if !q.schedule.contains(now) {
+		deliver()
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.held = append(q.held, deliver)
+	if q.timer == nil {
+		end := scheduleEnd(q.schedule, now)
+		q.timer = time.AfterFunc(end.Sub(now), q.release)
+		log.Info().Str("junction", q.junction).Time("until", end).Msg("Quiet hours, holding notification")
+	}
+}
+
+/*
+release sends every notification held during quiet hours
+*/
+func (q *quietHours) release() {
+	q.mu.Lock()
+	held := q.held
+	q.held = nil
+	q.timer = nil
+	q.mu.Unlock()
+
+	log.Info().Str("junction", q.junction).Int("notifications", len(held)).Msg("Quiet hours over, releasing notifications")
+	for _, deliver := range held {
+		deliver()
+	}
+}
+
+/*
+flush sends every held notification now, rather than waiting for quiet hours to end
+*/
+func (q *quietHours) flush() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	held := q.held
+	q.held = nil
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+
+	if len(held) > 0 {
+		log.Info().Str("junction", q.junction).Int("notifications", len(held)).Msg("Sending notifications held by quiet hours")
+	}
+	for _, deliver := range held {
+		deliver()
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCheckSchedule(t *testing.T) {
+	businessHours, err := parseSchedule(Schedule{
+		Timezone: "UTC",
+		Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+		Times:    []string{"09:00-17:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	overnight, err := parseSchedule(Schedule{
+		Timezone: "UTC",
+		Days:     []string{"Friday"},
+		Times:    []string{"22:00-07:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		schedule *schedule
+		time     string
+		result   bool
+	}{
+		{nil, "2024-01-01T03:00:00Z", true},
+		{businessHours, "2024-01-01T09:00:00Z", true},
+		{businessHours, "2024-01-01T16:59:00Z", true},
+		{businessHours, "2024-01-01T17:00:00Z", false},
+		{businessHours, "2024-01-01T03:00:00Z", false},
+		{businessHours, "2024-01-06T12:00:00Z", false},
+		{overnight, "2024-01-05T23:00:00Z", true},
+		{overnight, "2024-01-06T03:00:00Z", true},
+		{overnight, "2024-01-06T07:00:00Z", false},
+		{overnight, "2024-01-06T23:00:00Z", false},
+		{overnight, "2024-01-05T03:00:00Z", false},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, test.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := checkSchedule(test.schedule, now)
+			if res != test.result {
+				t.Errorf("received '%t', wanted '%t'", res, test.result)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	var tests = []Schedule{
+		{Timezone: "Not/AZone"},
+		{Days: []string{"someday"}},
+		{Times: []string{"9am-5pm"}},
+		{Times: []string{"09:00"}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseSchedule(test); err == nil {
+				t.Errorf("expected an error for %+v", test)
+			}
+		})
+	}
+}
+
+func TestScheduleEnd(t *testing.T) {
+	businessHours, err := parseSchedule(Schedule{
+		Timezone: "UTC",
+		Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+		Times:    []string{"09:00-17:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	overnight, err := parseSchedule(Schedule{
+		Timezone: "UTC",
+		Days:     []string{"Friday"},
+		Times:    []string{"22:00-07:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nightly, err := parseSchedule(Schedule{
+		Timezone: "UTC",
+		Times:    []string{"22:00-07:00"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		schedule *schedule
+		time     string
+		end      string
+	}{
+		{businessHours, "2024-01-01T10:00:00Z", "2024-01-01T17:00:00Z"},
+		{businessHours, "2024-01-01T16:59:30Z", "2024-01-01T17:00:00Z"},
+		// Outside the schedule, the next minute is already outside
+		{businessHours, "2024-01-01T03:00:00Z", "2024-01-01T03:01:00Z"},
+		// A range that wraps past midnight ends the next morning
+		{overnight, "2024-01-05T23:00:00Z", "2024-01-06T07:00:00Z"},
+		{overnight, "2024-01-06T03:30:15Z", "2024-01-06T07:00:00Z"},
+		// Consecutive nights don't join up, the schedule ends each morning
+		{nightly, "2024-01-05T21:59:00Z", "2024-01-06T07:00:00Z"},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, test.time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wanted, err := time.Parse(time.RFC3339, test.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if received := scheduleEnd(test.schedule, now); !received.Equal(wanted) {
+				t.Errorf("received '%s', wanted '%s'", received, wanted)
+			}
+		})
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	// Quiet from an hour ago until an hour before that, a range that wraps past midnight unless it's between 1am and 2am
+	now := time.Now().UTC()
+	quiet := fmt.Sprintf("%s-%s", now.Add(-time.Hour).Format("15:04"), now.Add(-2*time.Hour).Format("15:04"))
+	q, err := newQuietHours("test", Schedule{Timezone: "UTC", Times: []string{quiet}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Notifications are held in order while quiet hours are active
+	var delivered []int
+	for i := 0; i < 3; i++ {
+		i := i
+		q.admit(func() { delivered = append(delivered, i) })
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("received '%d' deliveries, wanted '%d' during quiet hours", len(delivered), 0)
+	}
+	q.mu.Lock()
+	held, scheduled := len(q.held), q.timer != nil
+	q.mu.Unlock()
+	if held != 3 || !scheduled {
+		t.Fatalf("received '%d' held and scheduled '%t', wanted '%d' held and a release scheduled", held, scheduled, 3)
+	}
+
+	// Once they're over, everything held is sent and nothing is left waiting
+	q.mu.Lock()
+	q.timer.Stop()
+	q.mu.Unlock()
+	q.release()
+	if fmt.Sprint(delivered) != "[0 1 2]" {
+		t.Errorf("received '%v', wanted '%v'", delivered, "[0 1 2]")
+	}
+	q.mu.Lock()
+	held, scheduled = len(q.held), q.timer != nil
+	q.mu.Unlock()
+	if held != 0 || scheduled {
+		t.Errorf("received '%d' held and scheduled '%t', wanted nothing left", held, scheduled)
+	}
+
+	// Outside quiet hours notifications are sent straight away
+	quiet = fmt.Sprintf("%s-%s", now.Add(time.Hour).Format("15:04"), now.Add(2*time.Hour).Format("15:04"))
+	if q, err = newQuietHours("test", Schedule{Timezone: "UTC", Times: []string{quiet}}); err != nil {
+		t.Fatal(err)
+	}
+	delivered = nil
+	q.admit(func() { delivered = append(delivered, 0) })
+	if len(delivered) != 1 {
+		t.Errorf("received '%d' deliveries, wanted '%d' outside quiet hours", len(delivered), 1)
+	}
+}
+
+func TestQuietHoursNil(t *testing.T) {
+	q, err := newQuietHours("test", Schedule{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := false
+	q.admit(func() { delivered = true })
+	if !delivered {
+		t.Error("received no delivery, wanted no quiet hours to send immediately")
+	}
+	q.flush()
+}
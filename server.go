@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhale/smtpd"
+	"github.com/rs/zerolog/log"
+)
+
+// Defaults used when the config doesn't set them
+const (
+	defaultShutdownGrace = 8 * time.Second
+	defaultSMTPTimeout   = 5 * time.Minute
+	defaultAppname       = "smtpd"
+)
+
+type SMTP struct {
+	Listen        []string      `yaml:"listen,omitempty"`
+	Hostname      string        `yaml:"hostname,omitempty"`
+	Appname       string        `yaml:"appname,omitempty"`
+	MaxSize       int           `yaml:"max-size,omitempty"`
+	ReadTimeout   time.Duration `yaml:"read-timeout,omitempty"`
+	WriteTimeout  time.Duration `yaml:"write-timeout,omitempty"`
+	MaxRecipients int           `yaml:"max-recipients,omitempty"`
+}
+
+// Exit codes
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitTimedOut = 2
+)
+
+/*
+startServer listens on the configured addresses and receives emails until the context is cancelled,
+then shuts down gracefully.
+
+Parameters:
+
+	ctx - Cancelled when the server should shut down
+
+Returns:
+
+	int - The exit code, exitTimedOut if the grace period ran out before everything finished
+*/
+func startServer(ctx context.Context) int {
+	hostname := smtpConf.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	appname := smtpConf.Appname
+	if appname == "" {
+		appname = defaultAppname
+	}
+	srv := &smtpd.Server{
+		Appname:     appname,
+		Hostname:    hostname,
+		Handler:     mailHandler,
+		HandlerRcpt: recipients.admit,
+		MaxSize:     smtpConf.MaxSize,
+		Timeout:     defaultSMTPTimeout,
+	}
+
+	addrs := listenAddrs(smtpConf.Listen, port)
+	var listeners []*smtpListener
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Error().Err(err).Str("address", addr).Msg("Error with the SMTP server")
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return exitError
+		}
+		log.Info().Msg(fmt.Sprintf("Listening on %s", ln.Addr()))
+		listeners = append(listeners, &smtpListener{Listener: ln, srv: srv})
+	}
+
+	return serveUntil(ctx, srv, listeners)
+}
+
+/*
+serveUntil serves emails on the listeners until the context is cancelled, then shuts down gracefully.
+Sessions waiting for their next email are closed straight away, and the others as soon as their email is received.
+SMTP sessions and queued deliveries share the shutdown grace period to finish.
+
+Parameters:
+
+	ctx       - Cancelled when the server should shut down
+	srv       - The SMTP server
+	listeners - The listeners to serve
+
+Returns:
+
+	int       - The exit code, exitTimedOut if the grace period ran out before everything finished
+*/
+func serveUntil(ctx context.Context, srv *smtpd.Server, listeners []*smtpListener) int {
+	// smtpd can serve any number of listeners, each in its own goroutine
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener *smtpListener) { served <- srv.Serve(listener) }(listener)
+	}
+
+	select {
+	case err := <-served:
+		log.Error().Err(err).Msg("Error with the SMTP server")
+		return exitError
+	case <-ctx.Done():
+	}
+
+	grace := shutdownGrace
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	log.Info().Dur("grace", grace).Msg("Shutting down")
+	graceCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	// Stop accepting connections, smtpd only checks for shutdown between connections
+	srv.Close()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	for range listeners {
+		<-served
+	}
+
+	// smtpd doesn't end open sessions, so close the idle ones and let the current SMTP transactions finish
+	for _, listener := range listeners {
+		listener.closeSessions(false)
+	}
+	code := exitOK
+	for _, listener := range listeners {
+		if err := listener.wait(graceCtx); err != nil {
+			log.Warn().Msg("SMTP sessions still open after the grace period, closing them")
+			code = exitTimedOut
+			for _, listener := range listeners {
+				listener.closeSessions(true)
+			}
+			break
+		}
+	}
+
+	// Send what's been collected or held, then deliver everything queued in what's left of the grace period
+	flushDigests()
+	flushHeld()
+	if err := deliveries.shutdown(graceCtx); err != nil {
+		log.Warn().Msg("Deliveries still running after the grace period, cancelling them")
+		code = exitTimedOut
+	}
+	saveDedupeState()
+
+	log.Info().Int("exit_code", code).Msg("Shut down")
+	return code
+}
+
+/*
+listenAddrs determines the addresses to listen on
+
+Parameters:
+
+	listen   - The configured addresses, such as "127.0.0.1:25" or "[::1]:25"
+	port     - The port to listen on all interfaces with if no addresses are configured
+
+Returns:
+
+	[]string - The addresses to listen on
+*/
+func listenAddrs(listen []string, port string) []string {
+	if len(listen) == 0 {
+		return []string{fmt.Sprintf(":%s", port)}
+	}
+
+	addrs := make([]string, 0, len(listen))
+	for _, addr := range listen {
+		// A bare host listens on the configured port
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// smtpListener turns away hosts that aren't allowed with a 554 and new connections with a 421
+// while the delivery queue is full, and tracks the connections that are open so shutdown can wait for them
+type smtpListener struct {
+	net.Listener
+	srv  *smtpd.Server
+	open sync.WaitGroup
+
+	// mu guards conns, the connections that are open
+	mu    sync.Mutex
+	conns map[*trackedConn]bool
+}
+
+/*
+Accept waits for the next connection, refusing any from hosts that aren't allowed or that arrive while the delivery queue is full
+
+Returns:
+
+	net.Conn - The accepted connection
+	error    - Why the listener can't accept connections
+*/
+func (l *smtpListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Refuse hosts that aren't allowed before they can send anything
+		if !connFilter.allowed(addrIP(conn.RemoteAddr())) {
+			log.Warn().Str("remote_ip", conn.RemoteAddr().String()).Msg("Host not allowed, refusing connection")
+			emailsRejected.WithLabelValues("denied").Inc()
+			go l.refuse(conn, "554 5.7.1 %s Access denied")
+			continue
+		}
+
+		if deliveries.saturated() {
+			log.Warn().Str("remote_ip", conn.RemoteAddr().String()).Msg("Delivery queue is full, refusing connection")
+			emailsRejected.WithLabelValues("busy").Inc()
+			go l.refuse(conn, "421 4.3.2 %s Service busy, try again later")
+			continue
+		}
+
+		tracked := &trackedConn{
+			Conn:         conn,
+			hostname:     l.srv.Hostname,
+			readTimeout:  smtpConf.ReadTimeout,
+			writeTimeout: smtpConf.WriteTimeout,
+		}
+		tracked.done = func() { l.untrack(tracked) }
+		l.track(tracked)
+		return tracked, nil
+	}
+}
+
+/*
+track records a connection as open
+
+Parameters:
+
+	conn - The accepted connection
+*/
+func (l *smtpListener) track(conn *trackedConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns == nil {
+		l.conns = map[*trackedConn]bool{}
+	}
+	l.conns[conn] = true
+	l.open.Add(1)
+}
+
+/*
+untrack records a connection as closed
+
+Parameters:
+
+	conn - The closed connection
+*/
+func (l *smtpListener) untrack(conn *trackedConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+	l.open.Done()
+}
+
+/*
+closeSessions ends the open SMTP sessions for shutdown with a 421.
+Sessions in the middle of an email are left to finish it, unless forced.
+
+Parameters:
+
+	force - Whether to close sessions in the middle of an email too
+*/
+func (l *smtpListener) closeSessions(force bool) {
+	l.mu.Lock()
+	conns := make([]*trackedConn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.shutdown(force)
+	}
+}
+
+/*
+refuse sends a connection an SMTP reply in place of the greeting, then closes it.
+Run in its own goroutine so a slow client can't hold up the listener.
+
+Parameters:
+
+	conn  - The refused connection
+	reply - The reply, with a %s for the hostname
+*/
+func (l *smtpListener) refuse(conn net.Conn, reply string) {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, reply+"\r\n", l.srv.Hostname)
+	conn.Close()
+}
+
+/*
+wait blocks until every accepted connection has closed
+
+Parameters:
+
+	ctx   - Stops waiting when done
+
+Returns:
+
+	error - The context's error if it finished first
+*/
+func (l *smtpListener) wait(ctx context.Context) error {
+	closed := make(chan struct{})
+	go func() {
+		l.open.Wait()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackedConn reports when it is closed, follows whether an email is being sent so shutdown can close it between emails,
+// and applies separate read and write timeouts in place of smtpd's single one
+type trackedConn struct {
+	net.Conn
+	once         sync.Once
+	done         func()
+	hostname     string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// mu guards the session's state, and serializes smtpd's replies with the shutdown's 421
+	mu            sync.Mutex
+	inTransaction bool // MAIL was accepted, and the email hasn't been received or refused yet
+	inData        bool // The email's data is being received
+	resetting     bool // The client sent RSET, HELO or EHLO, which abandon the current email once accepted
+	draining      bool // Shutting down, so close the session once its email is finished
+	closing       bool // The session was closed for shutdown
+}
+
+/*
+Close closes the connection, reporting it the first time
+
+Returns:
+
+	error - Why the connection can't be closed
+*/
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		recipients.forget(c.RemoteAddr())
+		rejections.take(c.RemoteAddr())
+		c.done()
+	})
+	return c.Conn.Close()
+}
+
+/*
+Write sends data to the client, replacing smtpd's 451 for an email a junction rejected with the junction's reply,
+and its 550 for a recipient over the limit with a 452
+
+Parameters:
+
+	b     - The data to send
+
+Returns:
+
+	int   - How much of the data was sent
+	error - Why the data can't be sent
+*/
+func (c *trackedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return 0, net.ErrClosed
+	}
+
+	reply := b
+	if bytes.HasPrefix(b, handlerErrorReply) || bytes.HasPrefix(b, rcptRefusedReply) {
+		if rejection, ok := rejections.take(c.RemoteAddr()); ok {
+			reply = []byte(rejection + "\r\n")
+		}
+	}
+	if _, err := c.Conn.Write(reply); err != nil {
+		return 0, err
+	}
+
+	c.follow(reply)
+	if c.draining && !c.inTransaction {
+		c.closeSession()
+	}
+	return len(b), nil
+}
+
+/*
+Read receives data from the client, noting the commands that abandon the current email
+
+Parameters:
+
+	b     - Where to put the data
+
+Returns:
+
+	int   - How much data was received
+	error - Why the data can't be received
+*/
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		// smtpd doesn't offer pipelining, so outside an email's data each read is a single command
+		if !c.inData {
+			verb, _, _ := strings.Cut(strings.TrimSpace(string(b[:n])), " ")
+			switch strings.ToUpper(verb) {
+			case "RSET", "HELO", "EHLO":
+				c.resetting = true
+			}
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+/*
+follow tracks whether an email is being sent from smtpd's replies, which are each written in one go.
+A transaction starts when MAIL is accepted, and ends with the reply to the email's data or an accepted RSET, HELO or EHLO.
+
+Parameters:
+
+	reply - The reply smtpd sent
+*/
+func (c *trackedConn) follow(reply []byte) {
+	resetting := c.resetting
+	c.resetting = false
+
+	switch {
+	case resetting && bytes.HasPrefix(reply, []byte("250")):
+		c.inTransaction = false
+	case c.inData:
+		c.inData = false
+		c.inTransaction = false
+	case bytes.HasPrefix(reply, []byte("354 ")):
+		c.inData = true
+	case bytes.HasPrefix(reply, []byte("250 2.1.0 ")):
+		// smtpd starts a new list of recipients with every MAIL, so start counting them again
+		c.inTransaction = true
+		recipients.forget(c.RemoteAddr())
+	}
+}
+
+/*
+shutdown closes the session if it's between emails, otherwise once its email is finished
+
+Parameters:
+
+	force - Whether to close the session even in the middle of an email
+*/
+func (c *trackedConn) shutdown(force bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	if c.inTransaction && !force {
+		return
+	}
+	c.closeSession()
+}
+
+/*
+closeSession tells the client the server is shutting down, then closes the connection under smtpd,
+which ends the session when its next read fails. The caller must hold mu.
+*/
+func (c *trackedConn) closeSession() {
+	if c.closing {
+		return
+	}
+	c.closing = true
+	c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c.Conn, "421 4.3.2 %s Service shutting down\r\n", c.hostname)
+	c.Conn.Close()
+}
+
+/*
+SetReadDeadline sets how long smtpd waits for the client, using the configured read timeout if there is one
+
+Parameters:
+
+	t     - The deadline smtpd asked for
+
+Returns:
+
+	error - Why the deadline can't be set
+*/
+func (c *trackedConn) SetReadDeadline(t time.Time) error {
+	if c.readTimeout > 0 && !t.IsZero() {
+		t = time.Now().Add(c.readTimeout)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+/*
+SetWriteDeadline sets how long smtpd waits to send a reply, using the configured write timeout if there is one
+
+Parameters:
+
+	t     - The deadline smtpd asked for
+
+Returns:
+
+	error - Why the deadline can't be set
+*/
+func (c *trackedConn) SetWriteDeadline(t time.Time) error {
+	if c.writeTimeout > 0 && !t.IsZero() {
+		t = time.Now().Add(c.writeTimeout)
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// The replies smtpd sends whenever mailHandler returns an error, and whenever recipients.admit refuses a recipient
+var (
+	handlerErrorReply = []byte("451 4.3.5 ")
+	rcptRefusedReply  = []byte("550 5.1.0 ")
+)
+
+// The reply for a recipient over the limit, temporary so the sender retries it in another transaction
+const tooManyRecipientsReply = "452 4.5.3 Too many recipients"
+
+// rejectionList holds the replies for emails junctions rejected and recipients over the limit, until smtpd replies to them
+type rejectionList struct {
+	mu      sync.Mutex
+	replies map[string]string
+}
+
+var rejections = &rejectionList{replies: map[string]string{}}
+
+/*
+set stores the reply for the email being received on a connection
+
+Parameters:
+
+	remoteAddr - The client's address, which identifies the connection
+	reply      - The SMTP reply to send instead of smtpd's
+*/
+func (r *rejectionList) set(remoteAddr net.Addr, reply string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replies[remoteAddr.String()] = reply
+}
+
+/*
+take removes and returns the reply stored for a connection
+
+Parameters:
+
+	remoteAddr - The client's address
+
+Returns:
+
+	string     - The reply
+	bool       - Whether a reply was stored
+*/
+func (r *rejectionList) take(remoteAddr net.Addr) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := remoteAddr.String()
+	reply, ok := r.replies[key]
+	delete(r.replies, key)
+	return reply, ok
+}
+
+// recipientCounter counts the recipients accepted on each connection, as smtpd only limits them to 100
+type recipientCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var recipients = &recipientCounter{counts: map[string]int{}}
+
+/*
+admit accepts a recipient unless the connection's current email already has the maximum.
+A refused recipient is sent a 452 in place of smtpd's 550.
+
+Parameters:
+
+	remoteAddr - The client's address, which identifies the connection
+	from       - The envelope sender
+	to         - The recipient being added
+
+Returns:
+
+	bool       - Whether the recipient is accepted
+*/
+func (r *recipientCounter) admit(remoteAddr net.Addr, from string, to string) bool {
+	if smtpConf.MaxRecipients <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := remoteAddr.String()
+	if r.counts[key] >= smtpConf.MaxRecipients {
+		log.Warn().Str("remote_addr", key).Str("to", to).Int("max", smtpConf.MaxRecipients).Msg("Too many recipients, refusing recipient")
+		rejections.set(remoteAddr, tooManyRecipientsReply)
+		return false
+	}
+	r.counts[key]++
+	return true
+}
+
+/*
+forget resets the count for a connection, when it starts a new email or closes
+
+Parameters:
+
+	remoteAddr - The client's address
+*/
+func (r *recipientCounter) forget(remoteAddr net.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.counts, remoteAddr.String())
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mhale/smtpd"
+)
+
+func TestListenAddrs(t *testing.T) {
+	var tests = []struct {
+		listen []string
+		port   string
+		want   []string
+	}{
+		{nil, "8025", []string{":8025"}},
+		{[]string{"127.0.0.1:25"}, "8025", []string{"127.0.0.1:25"}},
+		{[]string{"127.0.0.1", "::1"}, "2525", []string{"127.0.0.1:2525", "[::1]:2525"}},
+		{[]string{"[::1]", "[::]:25"}, "8025", []string{"[::1]:8025", "[::]:25"}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			addrs := listenAddrs(test.listen, test.port)
+			if fmt.Sprint(addrs) != fmt.Sprint(test.want) {
+				t.Errorf("received '%v', wanted '%v'", addrs, test.want)
+			}
+		})
+	}
+}
+
+/*
+startTestServer serves emails on a local address, the way startServer does, until it is stopped
+
+Parameters:
+
+	handler    - Receives every email
+
+Returns:
+
+	string     - The server's address
+	func() int - Shuts the server down, returning its exit code
+*/
+func startTestServer(t *testing.T, handler smtpd.Handler) (string, func() int) {
+	srv := &smtpd.Server{
+		Hostname:    "junction.test",
+		Handler:     handler,
+		HandlerRcpt: recipients.admit,
+		MaxSize:     smtpConf.MaxSize,
+		Timeout:     defaultSMTPTimeout,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exited := make(chan int, 1)
+	go func() { exited <- serveUntil(ctx, srv, []*smtpListener{{Listener: ln, srv: srv}}) }()
+	t.Cleanup(cancel)
+
+	return ln.Addr().String(), func() int {
+		cancel()
+		return <-exited
+	}
+}
+
+/*
+dialTestServer connects to a test server and greets it
+
+Parameters:
+
+	addr             - The server's address
+
+Returns:
+
+	*textproto.Conn  - The connection, ready for MAIL
+*/
+func dialTestServer(t *testing.T, addr string) *textproto.Conn {
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Cmd("HELO client.test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestShutdownClosesIdleSessions(t *testing.T) {
+	defer func(previous time.Duration) { shutdownGrace = previous }(shutdownGrace)
+	shutdownGrace = 300 * time.Millisecond
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = startDeliveries(1, 10, time.Second)
+
+	addr, stop := startTestServer(t, nil)
+	idle := dialTestServer(t, addr)
+	reset := dialTestServer(t, addr)
+	runSession(t, reset, []smtpStep{
+		{"MAIL FROM:<server@example.com>", "", 250},
+		{"RSET", "", 250},
+	})
+
+	// Queued sends take most of the grace period, so only finish if the idle session doesn't hold up shutdown
+	var sent int32
+	for i := 0; i < 4; i++ {
+		deliveries.enqueue(context.Background(), func(ctx context.Context) {
+			select {
+			case <-time.After(50 * time.Millisecond):
+				atomic.AddInt32(&sent, 1)
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	if code := stop(); code != exitOK {
+		t.Errorf("received '%d', wanted '%d'", code, exitOK)
+	}
+	if sent := atomic.LoadInt32(&sent); sent != 4 {
+		t.Errorf("received '%d', wanted '%d'", sent, 4)
+	}
+	for _, conn := range []*textproto.Conn{idle, reset} {
+		if _, _, err := conn.ReadResponse(421); err != nil {
+			t.Errorf("received '%v', wanted a 421", err)
+		}
+	}
+}
+
+func TestShutdownFinishesCurrentEmail(t *testing.T) {
+	defer func(previous time.Duration) { shutdownGrace = previous }(shutdownGrace)
+	shutdownGrace = 2 * time.Second
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = startDeliveries(1, 10, time.Second)
+
+	received := make(chan string, 1)
+	addr, stop := startTestServer(t, func(remoteAddr net.Addr, from string, to []string, data []byte) error {
+		received <- from
+		return nil
+	})
+	conn := dialTestServer(t, addr)
+	for _, cmd := range []string{"MAIL FROM:<server@example.com>", "RCPT TO:<alerts@example.com>"} {
+		if _, err := conn.Cmd(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadResponse(250); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exited := make(chan int, 1)
+	go func() { exited <- stop() }()
+	time.Sleep(100 * time.Millisecond)
+
+	// The email started before shutdown is still received, then the session is closed
+	if _, err := conn.Cmd("DATA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadResponse(354); err != nil {
+		t.Fatal(err)
+	}
+	writer := conn.DotWriter()
+	fmt.Fprint(writer, "Subject: Disk full\r\n\r\nnas is full\r\n")
+	writer.Close()
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		t.Errorf("received '%v', wanted a 250", err)
+	}
+	if _, _, err := conn.ReadResponse(421); err != nil {
+		t.Errorf("received '%v', wanted a 421", err)
+	}
+
+	select {
+	case from := <-received:
+		if from != "server@example.com" {
+			t.Errorf("received '%s', wanted '%s'", from, "server@example.com")
+		}
+	default:
+		t.Error("received nothing, wanted the email")
+	}
+	if code := <-exited; code != exitOK {
+		t.Errorf("received '%d', wanted '%d'", code, exitOK)
+	}
+}
+
+// smtpStep is a command sent to a test server, or an email's data when body is set, and the reply it should get
+type smtpStep struct {
+	cmd  string
+	body string
+	code int
+}
+
+/*
+runSession sends each step to a test server, checking its reply
+
+Parameters:
+
+	conn  - The connection to the server
+	steps - What to send, in order
+*/
+func runSession(t *testing.T, conn *textproto.Conn, steps []smtpStep) {
+	for _, step := range steps {
+		if step.body != "" {
+			writer := conn.DotWriter()
+			fmt.Fprint(writer, step.body)
+			writer.Close()
+		} else if _, err := conn.Cmd(step.cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		code, msg, err := conn.ReadResponse(step.code)
+		if err != nil {
+			t.Errorf("received '%d %s', wanted '%d' for '%s'", code, msg, step.code, step.cmd)
+		}
+	}
+}
+
+func TestSMTPLimits(t *testing.T) {
+	defer func(previous SMTP) { smtpConf = previous }(smtpConf)
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = nil
+
+	email := "Subject: Disk full\r\n\r\nnas is full\r\n"
+	var tests = []struct {
+		smtp  SMTP
+		steps []smtpStep
+	}{
+		// Recipients over the limit are refused for now, and counted again for the next email
+		{SMTP{MaxRecipients: 2}, []smtpStep{
+			{"MAIL FROM:<server@example.com>", "", 250},
+			{"RCPT TO:<a@example.com>", "", 250},
+			{"RCPT TO:<b@example.com>", "", 250},
+			{"RCPT TO:<c@example.com>", "", 452},
+			{"DATA", "", 354},
+			{"", email, 250},
+			{"MAIL FROM:<server@example.com>", "", 250},
+			{"RCPT TO:<c@example.com>", "", 250},
+			{"RCPT TO:<d@example.com>", "", 250},
+			{"RCPT TO:<e@example.com>", "", 452},
+			{"RSET", "", 250},
+			{"MAIL FROM:<server@example.com>", "", 250},
+			{"RCPT TO:<e@example.com>", "", 250},
+			{"DATA", "", 354},
+			{"", email, 250},
+		}},
+		// Emails over the size limit are refused
+		{SMTP{MaxSize: 64}, []smtpStep{
+			{"MAIL FROM:<server@example.com>", "", 250},
+			{"RCPT TO:<a@example.com>", "", 250},
+			{"DATA", "", 354},
+			{"", "Subject: Disk full\r\n\r\n" + strings.Repeat("nas is full\r\n", 10), 552},
+			{"DATA", "", 354},
+			{"", email, 250},
+		}},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			smtpConf = test.smtp
+			addr, stop := startTestServer(t, func(remoteAddr net.Addr, from string, to []string, data []byte) error { return nil })
+			defer stop()
+
+			runSession(t, dialTestServer(t, addr), test.steps)
+		})
+	}
+}
+
+func TestSMTPReadTimeout(t *testing.T) {
+	defer func(previous SMTP) { smtpConf = previous }(smtpConf)
+	smtpConf = SMTP{ReadTimeout: 100 * time.Millisecond}
+
+	addr, stop := startTestServer(t, nil)
+	defer stop()
+	conn := dialTestServer(t, addr)
+
+	// A sender that goes quiet is told the connection is closing
+	start := time.Now()
+	if _, _, err := conn.ReadResponse(421); err != nil {
+		t.Errorf("received '%v', wanted a 421", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("received '%s', wanted the connection closed after the read timeout", elapsed)
+	}
+}
+
+func TestTrackedConnDeadlines(t *testing.T) {
+	var tests = []struct {
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		write        bool
+	}{
+		{50 * time.Millisecond, 0, false},
+		{0, 50 * time.Millisecond, true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			conn := &trackedConn{Conn: server, done: func() {}, readTimeout: test.readTimeout, writeTimeout: test.writeTimeout}
+			defer conn.Close()
+
+			// smtpd asks for its own, much longer, deadline, which the configured timeout replaces
+			start := time.Now()
+			var err error
+			if test.write {
+				conn.SetWriteDeadline(time.Now().Add(time.Hour))
+				_, err = conn.Write([]byte("250 2.0.0 Ok\r\n"))
+			} else {
+				conn.SetReadDeadline(time.Now().Add(time.Hour))
+				_, err = conn.Read(make([]byte, 1))
+			}
+
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Errorf("received '%v', wanted a timeout", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("received '%s', wanted the configured timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestRejectReply(t *testing.T) {
+	defer func(previous []Junction) { junctions = previous }(junctions)
+	defer func(previous *deliveryPool) { deliveries = previous }(deliveries)
+	deliveries = nil
+	junctions = []Junction{
+		{Action: actionReject, RejectMessage: "Not accepted here", From: JuncFrom{Email: "spam@example.com"}},
+		{Action: actionDrop},
+	}
+
+	addr, stop := startTestServer(t, mailHandler)
+	defer stop()
+	conn := dialTestServer(t, addr)
+
+	// smtpd's 451 for the handler's error reaches the sender as the junction's permanent rejection
+	runSession(t, conn, []smtpStep{
+		{"MAIL FROM:<spam@example.com>", "", 250},
+		{"RCPT TO:<alerts@example.com>", "", 250},
+		{"DATA", "", 354},
+	})
+	writer := conn.DotWriter()
+	fmt.Fprint(writer, "Subject: Cheap pills\r\n\r\nBuy now\r\n")
+	writer.Close()
+	code, msg, err := conn.ReadResponse(550)
+	if err != nil || msg != "5.7.1 Not accepted here" {
+		t.Errorf("received '%d %s', wanted '%s'", code, msg, rejectReply(junctions[0]))
+	}
+
+	// The next email on the connection isn't affected
+	runSession(t, conn, []smtpStep{
+		{"MAIL FROM:<server@example.com>", "", 250},
+		{"RCPT TO:<alerts@example.com>", "", 250},
+		{"DATA", "", 354},
+		{"", "Subject: Disk full\r\n\r\nnas is full\r\n", 250},
+	})
+}
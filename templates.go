@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// templateFuncs are the helper functions available to every template.
+// Arguments are ordered so the value being worked on can be piped in last.
+var templateFuncs = template.FuncMap{
+	"truncate":     truncate,
+	"regexFind":    regexFind,
+	"regexReplace": regexReplace,
+	"upper":        strings.ToUpper,
+	"lower":        strings.ToLower,
+	"trim":         strings.TrimSpace,
+	"parseDate":    parseDate,
+	"formatDate":   formatDate,
+	"now":          time.Now,
+	"default":      defaultValue,
+	"json":         toJSON,
+	"split":        split,
+	"join":         join,
+	"firstLine":    firstLine,
+	"header":       header,
+}
+
+// Compiled regular expressions, keyed by their pattern
+var regexCache sync.Map
+
+/*
+compileRegex compiles a pattern once, reusing it for every later call
+
+Parameters:
+
+	pattern        - The regular expression
+
+Returns:
+
+	*regexp.Regexp - The compiled expression
+	error          - Why the pattern is invalid
+*/
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	if cached, ok := regexCache.Load(pattern); ok {
+		return cached.(*regexp.Regexp), nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache.Store(pattern, compiled)
+	return compiled, nil
+}
+
+/*
+truncate shortens a string to at most length characters, ending it with "..." if anything was cut
+*/
+func truncate(length int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	if length <= 3 {
+		return string(runes[:length])
+	}
+	return string(runes[:length-3]) + "..."
+}
+
+/*
+regexFind returns the first capture group of the first match, or the whole match if the pattern has no groups
+*/
+func regexFind(pattern string, s string) (string, error) {
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	match := re.FindStringSubmatch(s)
+	switch {
+	case match == nil:
+		return "", nil
+	case len(match) > 1:
+		return match[1], nil
+	default:
+		return match[0], nil
+	}
+}
+
+/*
+regexReplace replaces every match of the pattern, the replacement can refer to groups with $1
+*/
+func regexReplace(pattern string, replacement string, s string) (string, error) {
+	re, err := compileRegex(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+/*
+parseDate reads a date in the format used by email headers, falling back to RFC 3339
+*/
+func parseDate(s string) (time.Time, error) {
+	if parsed, err := mail.ParseDate(s); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(s))
+}
+
+/*
+formatDate formats a time with a Go layout such as "2006-01-02 15:04"
+*/
+func formatDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+/*
+defaultValue returns the fallback if the value is empty
+*/
+func defaultValue(fallback interface{}, value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return fallback
+	case string:
+		if v == "" {
+			return fallback
+		}
+	case []string:
+		if len(v) == 0 {
+			return fallback
+		}
+	}
+	return value
+}
+
+/*
+toJSON encodes a value as JSON
+*/
+func toJSON(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+/*
+split splits a string on every separator
+*/
+func split(sep string, s string) []string {
+	return strings.Split(s, sep)
+}
+
+/*
+join joins a list of strings with the separator
+*/
+func join(sep string, list []string) string {
+	return strings.Join(list, sep)
+}
+
+/*
+firstLine returns the first non-empty line of a string
+*/
+func firstLine(s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+/*
+header looks up the first value of a header, ignoring case
+*/
+func header(name string, headers mail.Header) string {
+	return headers.Get(name)
+}
+
+/*
+newTemplate parses a template with the helper functions and shared templates available
+
+Parameters:
+
+	name               - The name of the template, used in errors
+	text               - The template
+
+Returns:
+
+	*template.Template - The parsed template
+	error              - Why the template can't be parsed
+*/
+func newTemplate(name string, text string) (*template.Template, error) {
+	templatesMu.RLock()
+	shared := sharedTemplates
+	templatesMu.RUnlock()
+
+	return newTemplateWith(shared, name, text)
+}
+
+/*
+newTemplateWith parses a template against a specific set of shared templates
+
+Parameters:
+
+	shared             - The shared templates to make available, may be nil
+	name               - The name of the template, used in errors
+	text               - The template
+
+Returns:
+
+	*template.Template - The parsed template
+	error              - Why the template can't be parsed
+*/
+func newTemplateWith(shared *template.Template, name string, text string) (*template.Template, error) {
+	if shared == nil {
+		return template.New(name).Funcs(templateFuncs).Parse(text)
+	}
+
+	clone, err := shared.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return clone.New(name).Parse(text)
+}
+
+// How often the template directory is checked for changed files
+const templateReloadInterval = 5 * time.Second
+
+// templateFile is one file from the template directory
+type templateFile struct {
+	modTime time.Time
+	text    string
+}
+
+var (
+	// templatesMu guards the shared templates and the compiled templates of every junction
+	templatesMu     sync.RWMutex
+	sharedTemplates *template.Template
+	inlineTemplates map[string]string
+	templateFiles   = map[string]templateFile{}
+)
+
+/*
+buildSharedTemplates parses every named template into one set that junction templates can reference
+
+Parameters:
+
+	inline             - Templates from the config, by name
+	files              - Templates from the template directory, by name
+
+Returns:
+
+	*template.Template - The set of named templates
+	error              - Why a template can't be parsed
+*/
+func buildSharedTemplates(inline map[string]string, files map[string]templateFile) (*template.Template, error) {
+	shared := template.New("").Funcs(templateFuncs)
+	for name, text := range inline {
+		if _, err := shared.New(name).Parse(text); err != nil {
+			return nil, err
+		}
+	}
+	for name, file := range files {
+		if _, err := shared.New(name).Parse(file.text); err != nil {
+			return nil, err
+		}
+	}
+	return shared, nil
+}
+
+/*
+loadTemplates reads the named templates from the config and template directory
+
+Parameters:
+
+	inline - Templates from the config, by name
+	dir    - The template directory, ignored if empty
+
+Returns:
+
+	error  - Why a template can't be read or parsed
+*/
+func loadTemplates(inline map[string]string, dir string) error {
+	files := map[string]templateFile{}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			file, err := readTemplateFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			files[templateName(entry.Name())] = file
+		}
+	}
+
+	shared, err := buildSharedTemplates(inline, files)
+	if err != nil {
+		return err
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	sharedTemplates = shared
+	inlineTemplates = inline
+	templateFiles = files
+	return nil
+}
+
+/*
+readTemplateFile reads a file from the template directory
+
+Parameters:
+
+	path         - The path of the file
+
+Returns:
+
+	templateFile - The file's contents and modification time
+	error        - Why the file can't be read
+*/
+func readTemplateFile(path string) (templateFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return templateFile{}, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return templateFile{}, err
+	}
+	return templateFile{modTime: info.ModTime(), text: string(b)}, nil
+}
+
+/*
+templateName gets the name a template file is referenced by, its file name without the extension
+*/
+func templateName(fileName string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
+}
+
+/*
+watchTemplates reloads changed files in the template directory in the background.
+A file that fails to parse is logged and its previous version kept, without affecting the other files.
+
+Parameters:
+
+	dir - The template directory, nothing is watched if empty
+*/
+func watchTemplates(dir string) {
+	if dir == "" {
+		return
+	}
+
+	go func() {
+		for range time.Tick(templateReloadInterval) {
+			reloadTemplateDir(dir)
+		}
+	}()
+}
+
+/*
+reloadTemplateDir checks each file in the template directory, and reloads any that were added, changed or removed
+
+Parameters:
+
+	dir - The template directory
+*/
+func reloadTemplateDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Error().Err(err).Str("path", dir).Msg("Error reading the template directory")
+		return
+	}
+
+	templatesMu.RLock()
+	current := templateFiles
+	inline := inlineTemplates
+	templatesMu.RUnlock()
+
+	// Apply each change on its own, so one broken file doesn't hold back the rest
+	files := make(map[string]templateFile, len(current))
+	for name, file := range current {
+		files[name] = file
+	}
+	changed := false
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := templateName(entry.Name())
+		seen[name] = true
+
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Error reading template")
+			continue
+		}
+		if previous, ok := files[name]; ok && previous.modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		file, err := readTemplateFile(path)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Error reading template")
+			continue
+		}
+		candidate := make(map[string]templateFile, len(files))
+		for n, f := range files {
+			candidate[n] = f
+		}
+		candidate[name] = file
+		if _, err := buildSharedTemplates(inline, candidate); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Can't parse the template, keeping the previous version")
+			// Remember the broken version's time so it isn't reported again until it changes
+			if previous, ok := files[name]; ok {
+				files[name] = templateFile{modTime: info.ModTime(), text: previous.text}
+			} else {
+				files[name] = templateFile{modTime: info.ModTime()}
+			}
+			continue
+		}
+		files = candidate
+		changed = true
+		log.Info().Str("path", path).Msg("Template reloaded")
+	}
+	for name := range files {
+		if !seen[name] {
+			delete(files, name)
+			changed = true
+			log.Info().Str("template", name).Msg("Template removed")
+		}
+	}
+
+	if !changed {
+		templatesMu.Lock()
+		templateFiles = files
+		templatesMu.Unlock()
+		return
+	}
+
+	if err := applyTemplates(inline, files); err != nil {
+		log.Error().Err(err).Msg("Can't apply the reloaded templates, keeping the previous versions")
+	}
+}
+
+/*
+applyTemplates replaces the shared templates and recompiles every junction's templates against them.
+Nothing is replaced if any junction's templates fail to compile.
+
+Parameters:
+
+	inline - Templates from the config, by name
+	files  - Templates from the template directory, by name
+
+Returns:
+
+	error  - Why the templates can't be compiled
+*/
+func applyTemplates(inline map[string]string, files map[string]templateFile) error {
+	shared, err := buildSharedTemplates(inline, files)
+	if err != nil {
+		return err
+	}
+
+	// Compile copies of the junctions, and only swap them in once they all succeed
+	templatesMu.RLock()
+	compiled := make([]Junction, len(junctions))
+	copy(compiled, junctions)
+	templatesMu.RUnlock()
+	digestTitles := make([]*template.Template, len(compiled))
+	digestBodies := make([]*template.Template, len(compiled))
+	dedupeKeys := make([]*template.Template, len(compiled))
+	for index := range compiled {
+		if err := compiled[index].compileTemplatesWith(shared); err != nil {
+			return fmt.Errorf("junction %s: %w", junctionID(index), err)
+		}
+		// Digests and dedupe keys can reference the shared templates too
+		if compiled[index].digester != nil {
+			if digestTitles[index], digestBodies[index], err = compileDigest(shared, compiled[index].Digest); err != nil {
+				return fmt.Errorf("junction %s: %w", junctionID(index), err)
+			}
+		}
+		if compiled[index].deduper != nil {
+			if dedupeKeys[index], err = compileDedupeKey(shared, compiled[index].Dedupe); err != nil {
+				return fmt.Errorf("junction %s: dedupe key: %w", junctionID(index), err)
+			}
+		}
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	sharedTemplates = shared
+	templateFiles = files
+	for index := range junctions {
+		junctions[index].titleTemplate = compiled[index].titleTemplate
+		junctions[index].bodyTemplate = compiled[index].bodyTemplate
+		junctions[index].appriseTemplate = compiled[index].appriseTemplate
+		junctions[index].typeTemplate = compiled[index].typeTemplate
+		junctions[index].priorityTemplate = compiled[index].priorityTemplate
+		junctions[index].execArgTemplates = compiled[index].execArgTemplates
+		junctions[index].execEnvTemplates = compiled[index].execEnvTemplates
+		if digester := junctions[index].digester; digester != nil {
+			digester.title, digester.body = digestTitles[index], digestBodies[index]
+		}
+		if deduper := junctions[index].deduper; deduper != nil {
+			deduper.key = dedupeKeys[index]
+		}
+	}
+	return nil
+}
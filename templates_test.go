@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	data := TemplateData{
+		Subject: "[CRITICAL] Disk /dev/sda1 at 95% on nas01",
+		Body:    "\n  First line  \nSecond line",
+		Date:    "Mon, 01 Jan 2024 15:04:05 +0000",
+		RawTo:   []string{"a@test.com", "b@test.com"},
+		Headers: mail.Header{"X-Priority": []string{"1"}},
+	}
+
+	var tests = []struct {
+		template string
+		result   string
+	}{
+		{`{{ truncate 10 .Subject }}`, "[CRITIC..."},
+		{`{{ .Subject | truncate 100 }}`, data.Subject},
+		{`{{ regexFind "^\\[(\\w+)\\]" .Subject }}`, "CRITICAL"},
+		{`{{ regexFind "\\d+%" .Subject }}`, "95%"},
+		{`{{ regexFind "missing" .Subject }}`, ""},
+		{`{{ regexReplace "on (\\w+)$" "@$1" .Subject }}`, "[CRITICAL] Disk /dev/sda1 at 95% @nas01"},
+		{`{{ upper "abc" }} {{ lower "ABC" }} {{ trim "  x  " }}`, "ABC abc x"},
+		{`{{ .Date | parseDate | formatDate "2006-01-02 15:04" }}`, "2024-01-01 15:04"},
+		{`{{ default "none" .MessageID }}`, "none"},
+		{`{{ default "none" .Subject | truncate 5 }}`, "[C..."},
+		{`{{ json .RawTo }}`, `["a@test.com","b@test.com"]`},
+		{`{{ split "," "a,b" | join "+" }}`, "a+b"},
+		{`{{ join ", " .RawTo }}`, "a@test.com, b@test.com"},
+		{`{{ firstLine .Body }}`, "First line"},
+		{`{{ header "x-priority" .Headers }}`, "1"},
+		{`{{ urlquery "a b" }}`, "a+b"},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := newTemplate(name, test.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			builder := &strings.Builder{}
+			if err := tmpl.Execute(builder, data); err != nil {
+				t.Fatal(err)
+			}
+			if builder.String() != test.result {
+				t.Errorf("received '%s', wanted '%s'", builder.String(), test.result)
+			}
+		})
+	}
+}
+
+func TestHeloName(t *testing.T) {
+	var tests = []struct {
+		received string
+		result   string
+	}{
+		{"from mail.example.com (unknown [1.1.1.1])\r\n        by junction (smtpd) with SMTP", "mail.example.com"},
+		{"by junction (smtpd) with SMTP", ""},
+		{"", ""},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			res := heloName(test.received)
+			if res != test.result {
+				t.Errorf("received '%s', wanted '%s'", res, test.result)
+			}
+		})
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	email := EmailData{
+		To:      []string{"testto@test.com"},
+		Subject: "A subject",
+		Body:    "A body",
+	}
+
+	var tests = []struct {
+		junction Junction
+		title    string
+		body     string
+		url      string
+		err      bool
+	}{
+		{Junction{Apprise: "json://localhost"}, "A subject", "A body", "json://localhost", false},
+		{Junction{Apprise: "json://localhost/{{ .To }}", Title: "{{ upper .Subject }}", Body: "{{ .Body }}!"}, "A SUBJECT", "A body!", "json://localhost/testto@test.com", false},
+		{Junction{Apprise: "json://localhost", Title: `{{ regexFind "(" .Subject }}`}, "", "", "", true},
+		{Junction{Apprise: "json://localhost", Routes: map[string]string{"ops": "discord://ops"}}, "A subject", "A body", "json://localhost", false},
+		{Junction{Routes: map[string]string{"ops": "discord://ops"}}, "", "", "", true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if err := test.junction.compileTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			n, err := buildMessage(email, test.junction)
+			if (err != nil) != test.err {
+				t.Fatalf("received error '%v', wanted an error: %t", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if n.Title != test.title || n.Body != test.body || n.URL != test.url {
+				t.Errorf("received '%s', '%s', '%s', wanted '%s', '%s', '%s'", n.Title, n.Body, n.URL, test.title, test.body, test.url)
+			}
+		})
+	}
+}
+
+func TestCompileTemplatesError(t *testing.T) {
+	junction := Junction{Apprise: "json://localhost", Body: "{{ .Body "}
+	if err := junction.compileTemplates(); err == nil {
+		t.Error("expected an error for an unterminated action")
+	}
+}
+
+func TestSharedTemplates(t *testing.T) {
+	dir := t.TempDir()
+	footer := filepath.Join(dir, "footer.tmpl")
+	write := func(text string, age time.Duration) {
+		if err := os.WriteFile(footer, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-age)
+		if err := os.Chtimes(footer, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(" - v1", time.Hour)
+
+	if err := loadTemplates(map[string]string{"report": "Report: {{ .Subject }}"}, dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadTemplates(nil, "") })
+	defer func(previous []Junction) { junctions = previous }(junctions)
+
+	junctions = []Junction{{
+		Apprise:       "json://localhost",
+		TitleTemplate: "report",
+		Body:          `{{ .Body }}{{ template "footer" . }}`,
+		Digest:        Digest{Max: 1, Title: `Digest{{ template "footer" . }}`},
+		Dedupe:        Dedupe{Window: time.Hour, Key: `{{ .Subject }}{{ template "footer" . }}`},
+	}}
+	if err := junctions[0].compileTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if junctions[0].digester, err = newDigester("test", junctions[0].Digest); err != nil {
+		t.Fatal(err)
+	}
+	if junctions[0].deduper, err = newDeduper("test", junctions[0].Dedupe); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(wantBody string) {
+		t.Helper()
+		n, err := buildMessage(EmailData{Subject: "Backup", Body: "Done"}, junctions[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Title != "Report: Backup" || n.Body != wantBody {
+			t.Errorf("received '%s', '%s', wanted 'Report: Backup', '%s'", n.Title, n.Body, wantBody)
+		}
+
+		// The digest and dedupe key use the same footer
+		data := newTemplateData(EmailData{Subject: "Backup"})
+		var title string
+		junctions[0].digester.add(data, func(t string, b string) { title = t })
+		if wantTitle := "Digest" + strings.TrimPrefix(wantBody, "Done"); title != wantTitle {
+			t.Errorf("received '%s', wanted '%s'", title, wantTitle)
+		}
+		key := &strings.Builder{}
+		if err := junctions[0].deduper.key.Execute(key, data); err != nil {
+			t.Fatal(err)
+		}
+		if wantKey := "Backup" + strings.TrimPrefix(wantBody, "Done"); key.String() != wantKey {
+			t.Errorf("received '%s', wanted '%s'", key.String(), wantKey)
+		}
+	}
+	check("Done - v1")
+
+	// A changed file is picked up on its own
+	write(" - v2", 30*time.Minute)
+	reloadTemplateDir(dir)
+	check("Done - v2")
+
+	// A broken file keeps the previous version
+	write(" - {{ .Broken ", 0)
+	reloadTemplateDir(dir)
+	check("Done - v2")
+}
+
+func TestTemplateReferenceErrors(t *testing.T) {
+	if err := loadTemplates(map[string]string{"report": "{{ .Subject }}"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadTemplates(nil, "") })
+
+	var tests = []Junction{
+		{Apprise: "json://localhost", BodyTemplate: "missing"},
+		{Apprise: "json://localhost", Body: "{{ .Body }}", BodyTemplate: "report"},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			if err := test.compileTemplates(); err == nil {
+				t.Errorf("expected an error for %+v", test)
+			}
+		})
+	}
+}
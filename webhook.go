@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type Webhook struct {
+	URL     string            `yaml:"url,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Secret  string            `yaml:"secret,omitempty"`
+	Timeout time.Duration     `yaml:"timeout,omitempty"`
+	Retries int               `yaml:"retries,omitempty"`
+}
+
+// The timeout used when the config doesn't set one
+const defaultWebhookTimeout = 10 * time.Second
+
+// webhookRetryDelay is the wait before the first retry, shortened in tests
+var webhookRetryDelay = time.Second
+
+// The header carrying the payload's signature when a secret is set
+const signatureHeader = "X-Junction-Signature"
+
+// WebhookPayload is the JSON posted to a webhook
+type WebhookPayload struct {
+	Junction string       `json:"junction"`
+	Title    string       `json:"title"`
+	Body     string       `json:"body"`
+	Email    EmailPayload `json:"email"`
+}
+
+// EmailPayload is the received email as it appears in a webhook's JSON
+type EmailPayload struct {
+	To        []string            `json:"to"`
+	From      string              `json:"from"`
+	Subject   string              `json:"subject"`
+	Body      string              `json:"body"`
+	Date      string              `json:"date"`
+	IP        string              `json:"ip"`
+	Headers   map[string][]string `json:"headers"`
+	MessageID string              `json:"message_id"`
+	Size      int                 `json:"size"`
+	Helo      string              `json:"helo"`
+	Received  time.Time           `json:"received"`
+	Fields    map[string]string   `json:"fields,omitempty"`
+	Tag       string              `json:"tag,omitempty"`
+	Auth      *AuthPayload        `json:"auth,omitempty"`
+}
+
+// AuthPayload is the results of the sender checks as they appear in a webhook's JSON
+type AuthPayload struct {
+	SPF   string `json:"spf"`
+	DKIM  string `json:"dkim"`
+	DMARC string `json:"dmarc"`
+}
+
+/*
+checkWebhook validates the junction's webhook
+
+Returns:
+
+	error - Why the webhook is invalid
+*/
+func (junction *Junction) checkWebhook() error {
+	if junction.Webhook.URL == "" {
+		return nil
+	}
+
+	parsed, err := neturl.Parse(junction.Webhook.URL)
+	if err != nil {
+		return fmt.Errorf("webhook url: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("webhook url must be http or https, not %q", parsed.Scheme)
+	}
+	if junction.Webhook.Retries < 0 {
+		return errors.New("webhook retries can't be negative")
+	}
+	return nil
+}
+
+/*
+webhookPayload builds the JSON posted to a webhook
+
+Parameters:
+
+	junction     - The name of the matched junction
+	email        - The received email
+	notification - The rendered notification
+
+Returns:
+
+	[]byte       - The JSON
+	error        - Why the email can't be encoded
+*/
+func webhookPayload(junction string, email EmailData, notification Notification) ([]byte, error) {
+	payload := WebhookPayload{
+		Junction: junction,
+		Title:    notification.Title,
+		Body:     notification.Body,
+		Email: EmailPayload{
+			To:        email.To,
+			From:      email.From,
+			Subject:   email.Subject,
+			Body:      email.Body,
+			Date:      email.Date,
+			IP:        email.IP,
+			Headers:   email.Headers,
+			MessageID: email.MessageID,
+			Size:      email.Size,
+			Helo:      email.Helo,
+			Received:  email.Received,
+			Fields:    email.Fields,
+			Tag:       email.Tag,
+		},
+	}
+	if email.Auth != (AuthResults{}) {
+		payload.Email.Auth = &AuthPayload{SPF: email.Auth.SPF, DKIM: email.Auth.DKIM, DMARC: email.Auth.DMARC}
+	}
+	return json.Marshal(payload)
+}
+
+/*
+signPayload signs a payload so the receiver can check it came from Junction
+
+Parameters:
+
+	secret  - The shared secret
+	payload - The JSON being posted
+
+Returns:
+
+	string  - The signature, as "sha256=" and the hex encoded HMAC-SHA256
+*/
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+sendWebhook posts a payload to the webhook, retrying failures, and records it like a notification
+
+Parameters:
+
+	ctx     - Carries the logger for the email being delivered, and the delivery's deadline
+	webhook - The junction's webhook
+	payload - The JSON to post
+*/
+func sendWebhook(ctx context.Context, webhook Webhook, payload []byte) {
+	logger := zerolog.Ctx(ctx)
+	const backend = "webhook"
+
+	start := time.Now()
+	var err error
+	for attempt := 0; attempt <= webhook.Retries; attempt++ {
+		if attempt > 0 {
+			// Back off before retrying, doubling the wait each time
+			delay := webhookRetryDelay << (attempt - 1)
+			logger.Warn().Err(err).Int("attempt", attempt).Dur("delay", delay).Msg("Webhook failed, retrying")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+				break
+			}
+		}
+
+		var retry bool
+		retry, err = postWebhook(ctx, webhook, payload)
+		if err == nil || !retry {
+			break
+		}
+	}
+	notifyDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		notificationsFailed.WithLabelValues(backend).Inc()
+		logger.Error().Err(err).Str("backend", backend).Str("status", "failed").Msg("Can't send the webhook")
+		return
+	}
+
+	notificationsSent.WithLabelValues(backend).Inc()
+	logger.Info().Str("backend", backend).Str("status", "delivered").Msg("Webhook sent")
+}
+
+/*
+postWebhook makes a single attempt at posting a payload
+
+Parameters:
+
+	ctx     - Limits how long the attempt can take
+	webhook - The junction's webhook
+	payload - The JSON to post
+
+Returns:
+
+	bool    - Whether the failure is worth retrying, such as a network error or a 5xx
+	error   - Why the webhook failed
+*/
+func postWebhook(ctx context.Context, webhook Webhook, payload []byte) (bool, error) {
+	timeout := webhook.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "junction")
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+	if webhook.Secret != "" {
+		req.Header.Set(signatureHeader, signPayload(webhook.Secret, payload))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook returned %s", resp.Status)
+}
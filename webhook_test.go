@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSendWebhook(t *testing.T) {
+	defer func(previous time.Duration) { webhookRetryDelay = previous }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	email := EmailData{
+		To:      []string{"alerts@example.com"},
+		From:    "server@example.com",
+		Subject: "Disk full",
+		Body:    "Host: nas",
+		Headers: mail.Header{"Subject": {"Disk full"}},
+		Fields:  map[string]string{"Host": "nas"},
+	}
+	payload, err := webhookPayload("storage", email, Notification{Title: "DISK FULL", Body: "nas is full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		statuses []int
+		retries  int
+		attempts int
+		sent     bool
+	}{
+		{[]int{200}, 0, 1, true},
+		{[]int{500, 502, 204}, 2, 3, true},
+		{[]int{500, 500, 500}, 1, 2, false},
+		{[]int{400, 200}, 3, 1, false},
+		{[]int{429, 200}, 1, 2, true},
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprint(i)
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			var received WebhookPayload
+			var signature, token string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				json.Unmarshal(body, &received)
+				signature = r.Header.Get(signatureHeader)
+				token = r.Header.Get("Authorization")
+				w.WriteHeader(test.statuses[attempts])
+				attempts++
+			}))
+			defer server.Close()
+
+			webhook := Webhook{URL: server.URL, Secret: "s3cret", Headers: map[string]string{"Authorization": "Bearer abc"}, Retries: test.retries}
+			sent := testutil.ToFloat64(notificationsSent.WithLabelValues("webhook"))
+			failed := testutil.ToFloat64(notificationsFailed.WithLabelValues("webhook"))
+			sendWebhook(context.Background(), webhook, payload)
+
+			// Each webhook is counted once, however many attempts it took
+			sent = testutil.ToFloat64(notificationsSent.WithLabelValues("webhook")) - sent
+			failed = testutil.ToFloat64(notificationsFailed.WithLabelValues("webhook")) - failed
+			if test.sent && (sent != 1 || failed != 0) {
+				t.Errorf("received '%v' sent and '%v' failed, wanted the webhook counted as sent", sent, failed)
+			}
+			if !test.sent && (sent != 0 || failed != 1) {
+				t.Errorf("received '%v' sent and '%v' failed, wanted the webhook counted as failed", sent, failed)
+			}
+
+			if attempts != test.attempts {
+				t.Errorf("received '%d' attempts, wanted '%d'", attempts, test.attempts)
+			}
+			if received.Junction != "storage" || received.Title != "DISK FULL" || received.Email.Fields["Host"] != "nas" || received.Email.Headers["Subject"][0] != "Disk full" {
+				t.Errorf("received '%+v'", received)
+			}
+			if signature != signPayload("s3cret", payload) {
+				t.Errorf("received '%s', wanted '%s'", signature, signPayload("s3cret", payload))
+			}
+			if token != "Bearer abc" {
+				t.Errorf("received '%s', wanted '%s'", token, "Bearer abc")
+			}
+		})
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	// From: echo -n '{"a":1}' | openssl dgst -sha256 -hmac key
+	want := "sha256=88a67f24bbcdaed0e6c997404bb79a743baf44c6bab2f4c27328e3009d22e342"
+	got := signPayload("key", []byte(`{"a":1}`))
+	if got != want {
+		t.Errorf("received '%s', wanted '%s'", got, want)
+	}
+}